@@ -1,13 +1,31 @@
 package simhash
 
 import (
+	"cmp"
 	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"log/slog"
+	"maps"
+	"math"
 	"math/big"
+	"math/bits"
 	"os"
+	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 )
 
 type HashFunc func([]byte) []byte
@@ -24,51 +42,269 @@ type Simhash struct {
 	Reg      *regexp.Regexp
 	HashFunc HashFunc
 	Log      *slog.Logger
+
+	// votes holds the weighted bit sums and count the total feature weight
+	// of the last build, they are nil/zero when the value was set directly
+	votes []int
+	count int
+
+	retainFeatures bool
+	features       map[string]int
+
+	fold bool
+
+	workers int
+
+	hashCache HashCache
+
+	pipeline []Step
+
+	subLinear bool
+
+	featureNormalizer func(string) string
+
+	transpositions bool
+
+	// hashName identifies the HashFunc set through the options, empty when
+	// unknown such as after decoding
+	hashName string
+
+	stringFormat StringFormat
+
+	weightOverride bool
+
+	stripDiacritics bool
+
+	maxTextBytes int
+
+	words         bool
+	subtokenRules SubtokenRules
+
+	// shortText holds the normalized text of a build with fewer features
+	// than shortTextThreshold, compared by edit distance when isShort
+	shortTextThreshold int
+	shortText          string
+	isShort            bool
+
+	padding HashPadding
+
+	shingleWidth int
+	raw          bool
+
+	byteNgrams int
+
+	shingleWeightCap int
+
+	positional func(pos, total int) float64
+
+	// shingles is the number of shingles of the last text build, checked
+	// against minShingles by AddText
+	shingles    int
+	minShingles int
+
+	// separator joins the regex matches in RegexStep
+	separator string
+
+	// hashEmpty builds text without shingles from the empty shingle, as
+	// Python does, instead of leaving the fingerprint zero
+	hashEmpty bool
+
+	byteSelection HashByteSelection
+}
+
+// WeightedFeature is one token with its weight, for building from an ordered
+// feature list that may repeat tokens
+type WeightedFeature struct {
+	Token  string
+	Weight int
 }
 
 var (
-	defaultF          = 64
-	defaultHashFunc   = defaultHashFunction
-	defaultLogger     = slog.New(slog.NewTextHandler(os.Stdout, nil))
-	batchSize         = 200
-	largeWeightCutoff = 50
-	defaultK          = 2
+	defaultF        = 64
+	defaultHashFunc = defaultHashFunction
+	defaultHashName = hashFuncName(defaultHashFunc)
+	defaultLogger   = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	defaultK        = 2
+
+	defaultShingleWidth = 4
+
+	// regexps are safe for concurrent use, so every Simhash shares these.
+	// pythonReg matches what Python's [\w\u4e00-\u9fcc]+ does on str,
+	// where \w covers every Unicode letter and number.
+	defaultReg = regexp.MustCompile(`[\p{Han}\p{L}\p{N}_]+`)
+	pythonReg  = regexp.MustCompile(`[\p{L}\p{N}_\x{4e00}-\x{9fcc}]+`)
+
+	// CompareAcrossF refuses dimensions further apart than this factor
+	maxFRatio = 4
+
+	// sublinear weights are scaled by this before rounding to integer votes
+	subLinearScale = 100.0
+
+	// positional weights are scaled by this before rounding to integer votes
+	positionalScale = 100.0
+
+	// feature sets at least this large are summed by several workers
+	concurrentBuildCutoff = 5000
+
+	// SimilarPairs switches from all-pairs to block bucketing past this size
+	// as long as every block keeps at least minBlockBits bits
+	similarPairsIndexCutoff = 256
+	minBlockBits            = 4
 )
 
 // Takes in:
 // string - then builds by text (slide then tokenise and then build by features)
-// map[string]int - already tokenised
+// map[string]int - already tokenised, a negative weight argues against the feature's bits
+// []WeightedFeature - already tokenised, repeated tokens summed unless WithWeightOverride
+// []byte - built like text, or from byte n-grams with WithByteNgrams
 // int64 or big.Int - initialise with a value
 // Or optional values:
 // F - dimension of fingerprints, default 64
 // HashFunc - default md5 func([]byte)[]byte
 // reg - is meaningful only when `value` is basestring and describes what is considered to be a letter inside parsed string
 // logger
+//
+// An invalid F is logged and reset to the default, use NewSimhashErr to get an error instead.
 func NewSimhash(value any, options ...Option) *Simhash {
+	s := newSimhash(options...)
+
+	if s.F%8 != 0 || s.F <= 0 {
+		s.Log.Error("f should be a multiple of 8 and not zero\ngot", "f:", s.F)
+		s.F = defaultF
+		s.FBytes = s.F / 8
+	}
+	if s.workers < 1 {
+		s.Log.Error("workers should be at least 1\ngot", "workers:", s.workers)
+		s.workers = runtime.NumCPU()
+	}
+	if s.shingleWidth < 1 {
+		s.Log.Error("shingle width should be at least 1\ngot", "width:", s.shingleWidth)
+		s.shingleWidth = defaultShingleWidth
+	}
+	if err := s.checkHashLen(); err != nil {
+		s.Log.Error("hash output too short, folding it instead", "err", err)
+		s.fold = true
+	}
+
+	return s.build(value)
+}
+
+// NewSimhashFromTokens builds a Simhash from features received on tokens,
+// weighting each by the number of times it arrives, once the channel is
+// closed. The producer can keep tokenizing while earlier tokens are counted.
+func NewSimhashFromTokens(tokens <-chan string, options ...Option) *Simhash {
+	features := make(map[string]int)
+	for token := range tokens {
+		features[token]++
+	}
+	return NewSimhash(features, options...)
+}
+
+// NewSimhashErr is like NewSimhash but returns an error instead of silently
+// recovering from an invalid configuration or an unsupported value type.
+func NewSimhashErr(value any, options ...Option) (*Simhash, error) {
+	s := newSimhash(options...)
+
+	if s.F%8 != 0 || s.F <= 0 {
+		return nil, fmt.Errorf("f should be a multiple of 8 and not zero, got %d", s.F)
+	}
+	if s.workers < 1 {
+		return nil, fmt.Errorf("workers should be at least 1, got %d", s.workers)
+	}
+	if s.shingleWidth < 1 {
+		return nil, fmt.Errorf("shingle width should be at least 1, got %d", s.shingleWidth)
+	}
+	if err := s.checkHashLen(); err != nil {
+		return nil, err
+	}
+
+	sh := s.build(value)
+	if sh == nil {
+		return nil, fmt.Errorf("unsupported simhash value type %T", value)
+	}
+	return sh, nil
+}
+
+// NewSimhashBatch builds a Simhash of every text with the same options in
+// parallel, returning them in the order of texts. The options are applied to
+// each Simhash, so an option compiling a pattern, such as WithRegexPattern,
+// compiles it once for the whole batch, and WithSharedRegex passes one
+// already compiled.
+func NewSimhashBatch(texts []string, options ...Option) []*Simhash {
+	results := make([]*Simhash, len(texts))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(runtime.NumCPU(), len(texts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(texts) {
+					return
+				}
+				results[i] = NewSimhash(texts[i], options...)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// bareSimhash wraps value as an f bit Simhash with the default settings, its
+// hash function unknown as after decoding
+func bareSimhash(value *big.Int, f int) *Simhash {
+	s := newSimhash(WithF(f))
+	s.Value = value
+	s.hashName = ""
+	return s
+}
+
+func newSimhash(options ...Option) *Simhash {
 	s := &Simhash{
 		F:        defaultF,
 		FBytes:   defaultF / 8,
 		HashFunc: defaultHashFunc,
-		Reg:      regexp.MustCompile(`[\p{Han}\p{L}\p{N}_]+`),
+		hashName: defaultHashName,
+		Reg:      defaultReg,
 		Log:      defaultLogger,
 		Value:    big.NewInt(0),
+		workers:  runtime.NumCPU(),
+
+		shingleWidth: defaultShingleWidth,
 	}
 
 	for _, opt := range options {
 		opt(s)
 	}
 
-	if s.F%8 != 0 || s.F == 0 {
-		s.Log.Error("f should be a multiple of 8 and not zero\ngot", "f:", s.F)
-		s.F = defaultF
-		s.FBytes = s.F / 8
+	return s
+}
+
+// checkHashLen hashes a probe input to make sure the HashFunc returns enough
+// bytes for F, unless folding is enabled
+func (s *Simhash) checkHashLen() error {
+	if s.folds() || s.padding != 0 {
+		return nil
 	}
+	if n := len(s.HashFunc([]byte("simhash probe"))); n < s.FBytes {
+		return fmt.Errorf("hash function returns %d bytes but f %d needs %d, use WithFold or a longer hash", n, s.F, s.FBytes)
+	}
+	return nil
+}
 
+func (s *Simhash) build(value any) *Simhash {
 	switch v := value.(type) {
 	case *Simhash:
 		s.Value.Set(v.Value)
 	case string:
 		return s.buildByText(v)
+	case []byte:
+		if s.byteNgrams > 0 {
+			return s.buildByBytes(v)
+		}
+		return s.buildByText(string(v))
 	case map[string]int:
 		return s.buildByFeatures(v)
 	case []string:
@@ -77,6 +313,16 @@ func NewSimhash(value any, options ...Option) *Simhash {
 			features[feature] = 1
 		}
 		return s.buildByFeatures(features)
+	case []WeightedFeature:
+		features := make(map[string]int, len(v))
+		for _, feature := range v {
+			if s.weightOverride {
+				features[feature.Token] = feature.Weight
+			} else {
+				features[feature.Token] += feature.Weight
+			}
+		}
+		return s.buildByFeatures(features)
 	case int64:
 		s.Value.SetInt64(v)
 	case *big.Int:
@@ -88,6 +334,16 @@ func NewSimhash(value any, options ...Option) *Simhash {
 	return s
 }
 
+// NormalizeAndFingerprint builds a Simhash from text exactly like NewSimhash
+// and also returns the normalized string that was shingled, cut to
+// WithMaxTextBytes and, with WithWordTokenizer, made of the word tokens
+// joined by spaces, so callers can check which differences were ignored.
+func NormalizeAndFingerprint(text string, options ...Option) (*Simhash, string) {
+	s := NewSimhash(int64(0), options...)
+	normalized, _ := s.prepareText(text)
+	return s.buildByText(text), normalized
+}
+
 type Option func(*Simhash)
 
 func WithF(f int) Option {
@@ -100,323 +356,2833 @@ func WithF(f int) Option {
 func WithHashFunc(hashFunc func([]byte) []byte) Option {
 	return func(s *Simhash) {
 		s.HashFunc = hashFunc
+		s.hashName = hashFuncName(hashFunc)
+	}
+}
+
+// WithHashFuncs hashes every feature with each of fns and concatenates the
+// outputs in order, the trailing FBytes of which make its contribution as
+// with a single HashFunc. The low bits so come from the last functions and
+// the high bits from the ones before, which keeps the bias of a weak hash
+// in some bit positions from carrying over to the ones another hash fills.
+// Outputs longer together than FBytes push the first functions out, unless
+// WithFold is used to fold the whole concatenation.
+func WithHashFuncs(fns ...HashFunc) Option {
+	return func(s *Simhash) {
+		names := make([]string, len(fns))
+		for i, fn := range fns {
+			names[i] = hashFuncName(fn)
+		}
+		s.HashFunc = func(data []byte) []byte {
+			var out []byte
+			for _, fn := range fns {
+				out = append(out, fn(data)...)
+			}
+			return out
+		}
+		s.hashName = strings.Join(names, "+")
+	}
+}
+
+// hashFuncName identifies a hash function by the name of its code, closures
+// created from the same function literal share a name
+func hashFuncName(fn HashFunc) string {
+	if fn == nil {
+		return ""
+	}
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+		return f.Name()
 	}
+	return ""
 }
 
 func WithRegexPattern(pattern string) Option {
 	if pattern != "" {
+		reg := regexp.MustCompile(pattern)
 		return func(s *Simhash) {
-			s.Reg = regexp.MustCompile(pattern)
+			s.Reg = reg
 		}
 	}
 	panic("incorrect regex pattern")
 }
 
-func WithLogger(log *slog.Logger) Option {
+// WithSharedRegex uses the already compiled reg as the Reg, so many Simhashes
+// built with the same pattern share it instead of compiling their own.
+// Matching with a regexp is safe for concurrent use.
+func WithSharedRegex(reg *regexp.Regexp) Option {
+	if reg == nil {
+		panic("incorrect regex pattern")
+	}
 	return func(s *Simhash) {
-		s.Log = log
+		s.Reg = reg
 	}
 }
 
-func (s *Simhash) Equal(s2 *Simhash) bool {
-	return s.Value.Cmp(s2.Value) == 0
+// WithRegexPatternSafe is like WithRegexPattern but compiles the pattern
+// right away, returning an error instead of panicking on an invalid one, for
+// patterns that come from users. Go regular expressions run in time linear
+// in the input, so no pattern can make tokenizing hang, see WithMaxTextBytes
+// to bound the input itself.
+func WithRegexPatternSafe(pattern string) (Option, error) {
+	if pattern == "" {
+		return nil, errors.New("empty regex pattern")
+	}
+	reg, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(s *Simhash) {
+		s.Reg = reg
+	}, nil
 }
 
-func (s *Simhash) slide(content string, width int) []string {
-	if len(content) < width {
-		return []string{content}
+// WithMaxTextBytes makes text builds only use the first n bytes of the text,
+// cut back to a whole character, bounding the work done on untrusted input.
+// The cut is made before normalizing, so the text returned by
+// NormalizeAndFingerprint and kept by WithShortTextFallback is cut too.
+// Zero, the default, means no limit.
+func WithMaxTextBytes(n int) Option {
+	return func(s *Simhash) {
+		s.maxTextBytes = n
 	}
+}
 
-	result := make([]string, 0, len(content)-width+1)
-	for i := 0; i <= len(content)-width; i++ {
-		result = append(result, content[i:i+width])
+func WithLogger(log *slog.Logger) Option {
+	return func(s *Simhash) {
+		s.Log = log
 	}
-	return result
 }
 
-func (s *Simhash) tokenize(content string) []string {
-	content = strings.ToLower(content)
-	matches := s.Reg.FindAllString(content, -1)
-	content = strings.Join(matches, "")
-
-	return s.slide(content, 4)
+// WithFold maps hash outputs of any length onto FBytes: longer digests are
+// XOR folded over FBytes sized chunks and shorter ones are extended by
+// rehashing the previous digest until they are long enough, then folded.
+// Without it the trailing FBytes of the digest are used, or the ones chosen
+// by WithHashByteSelection, which requires the HashFunc to return at least
+// FBytes bytes. Folding takes precedence over a leading or trailing
+// selection, whichever option comes last.
+func WithFold() Option {
+	return func(s *Simhash) {
+		s.fold = true
+	}
 }
 
-func (s *Simhash) buildByText(content string) *Simhash {
-	features := s.tokenize(content)
+// HashPadding selects how WithHashPadding extends hash outputs shorter than
+// FBytes
+type HashPadding int
+
+const (
+	// HashPadZero prepends zero bytes. It is the cheapest, but the padded
+	// high bits never vote, so they are always 0 in the fingerprint and the
+	// effective dimension shrinks to the hash length.
+	HashPadZero HashPadding = iota + 1
+	// HashPadRepeat repeats the output until it fills FBytes. Every bit
+	// votes, but the repeated bits always agree, so distances are multiples
+	// of the repetition and carry no more information than the hash.
+	HashPadRepeat
+	// HashPadCounter appends HashFunc(output || i) for i = 1, 2, ... until
+	// FBytes are filled. It costs extra hashing per feature but gives every
+	// bit an independent vote, keeping the full dimension meaningful.
+	HashPadCounter
+)
 
-	featureMap := make(map[string]int)
-	for _, feature := range features {
-		featureMap[feature]++
+// WithHashPadding makes outputs of a HashFunc that are shorter than FBytes
+// padded with mode instead of rejected, for hash functions with variable
+// length output. Outputs of at least FBytes are used as usual. WithFold takes
+// precedence when both are set.
+func WithHashPadding(mode HashPadding) Option {
+	return func(s *Simhash) {
+		s.padding = mode
 	}
-
-	return s.buildByFeatures(featureMap)
 }
 
-// from python implementation
-//
-// """
-// `features` might be a list of unweighted tokens (a weight of 1
-//
-//	will be assumed), a list of (token, weight) tuples or
-//	a token -> weight dict.
-// """
-// Don't need it since our newSimhash func already handles various input types for value
-
-func (s *Simhash) buildByFeatures(features map[string]int) *Simhash {
-	sums := make([][]int, 0)
-	batch := make([][]byte, 0)
-	count := 0
+// HashByteSelection selects which FBytes of a longer hash output make a
+// feature's contribution
+type HashByteSelection int
+
+const (
+	// HashBytesTrailing takes the last FBytes, the default and what the
+	// Python implementation does
+	HashBytesTrailing HashByteSelection = iota
+	// HashBytesLeading takes the first FBytes, for hash constructions whose
+	// leading bytes are the well mixed ones
+	HashBytesLeading
+	// HashBytesFold XOR folds the whole output onto FBytes, as WithFold
+	HashBytesFold
+)
 
-	for feature, weight := range features {
-		skipBatch := weight > largeWeightCutoff
-		count += weight
+// WithHashByteSelection sets which part of each hash output drives the
+// fingerprint. It is kept apart from WithFold, which folds the output
+// whatever the selection, so selecting the leading or trailing bytes doesn't
+// undo an earlier WithFold.
+func WithHashByteSelection(mode HashByteSelection) Option {
+	return func(s *Simhash) {
+		s.byteSelection = mode
+	}
+}
 
-		hashed := s.HashFunc([]byte(feature))
-		h := hashed[len(hashed)-s.FBytes:]
+// WithWorkers sets how many goroutines build fingerprints of large feature
+// sets concurrently, it defaults to runtime.NumCPU() and must be at least 1.
+// The HashFunc must be safe for concurrent use when n is above 1.
+func WithWorkers(n int) Option {
+	return func(s *Simhash) {
+		s.workers = n
+	}
+}
 
-		if skipBatch {
-			bitArray := bitArrayFromBytes(h)
-			weightedArray := make([]int, len(bitArray))
-			for i, bit := range bitArray {
-				weightedArray[i] = bit * weight
-			}
-			sums = append(sums, weightedArray)
-		} else {
-			for range weight {
-				batch = append(batch, h)
-			}
+// WithHashCache memoizes token hashes in cache, which can be shared across
+// builds that use the same HashFunc
+func WithHashCache(cache HashCache) Option {
+	return func(s *Simhash) {
+		s.hashCache = cache
+	}
+}
 
-			if len(batch) >= batchSize {
-				sums = append(sums, sumHashes(batch, s.F))
-				batch = make([][]byte, 0)
-			}
+// WithPipeline sets the steps text goes through before shingling, in order.
+// The default is LowercaseStep then RegexStep. Custom steps, such as a
+// Unicode normalization form, can be placed anywhere in the pipeline.
+func WithPipeline(steps []Step) Option {
+	return func(s *Simhash) {
+		s.pipeline = slices.Clone(steps)
+		if s.pipeline == nil {
+			s.pipeline = []Step{}
 		}
+	}
+}
 
-		if len(sums) >= batchSize {
-			sums = [][]int{sumHashesBytes(sums)}
-		}
+// WithoutLowercase keeps the case of the text, it is the same as
+// WithPipeline([]Step{RegexStep})
+func WithoutLowercase() Option {
+	return WithPipeline([]Step{RegexStep})
+}
+
+// WithShingleWidth sets how many characters make a text shingle, 4 by
+// default
+func WithShingleWidth(n int) Option {
+	return func(s *Simhash) {
+		s.shingleWidth = n
 	}
+}
 
-	if len(batch) > 0 {
-		sums = append(sums, sumHashes(batch, s.F))
+// WithByteNgrams makes []byte input fingerprinted from its overlapping n byte
+// windows, for binary data such as firmware or media files. The text
+// pipeline and regex are not applied.
+func WithByteNgrams(n int) Option {
+	return func(s *Simhash) {
+		s.byteNgrams = n
 	}
+}
 
-	combinedSums := sumHashesBytes(sums)
+// WithShingleWeightCap caps the weight of each text shingle at n, however
+// often it repeats, so boilerplate repeated throughout a document can't wash
+// out its distinctive content. Zero, the default, means no cap.
+func WithShingleWeightCap(n int) Option {
+	return func(s *Simhash) {
+		s.shingleWeightCap = n
+	}
+}
 
-	finalBits := make([]int, len(combinedSums))
-	for i, val := range combinedSums {
-		if val > count/2 {
-			finalBits[i] = 1
-		}
+// WithPositionalWeighting weights every shingle occurrence of a text by
+// fn(pos, total), pos being its position among the total shingles, instead
+// of 1, so for example earlier shingles can count more. The summed weight of
+// a shingle is scaled by 100 and rounded to an integer vote. A negative
+// result argues against the shingle's bits. The default is uniform.
+func WithPositionalWeighting(fn func(pos, total int) float64) Option {
+	return func(s *Simhash) {
+		s.positional = fn
 	}
+}
 
-	s.Value.SetBytes(packBits(finalBits))
-	return s
+// WithWhitespaceNormalization makes RegexStep separate the words it keeps by
+// a single space instead of joining them, so shingles span word boundaries
+// and "foo bar" no longer fingerprints like "foobar". Whatever ran between
+// two words, punctuation or runs of whitespace, collapses to the one space.
+func WithWhitespaceNormalization() Option {
+	return func(s *Simhash) {
+		s.separator = " "
+	}
 }
 
-func bitArrayFromBytes(hash []byte) []int {
-	bitArray := make([]int, 0, len(hash)*8)
-	for _, b := range hash {
-		for i := 7; i >= 0; i-- {
-			bit := (b >> i) & 1
-			bitArray = append(bitArray, int(bit))
-		}
+// WithPythonCompat configures the Simhash the way the Python simhash
+// package, which this one is ported from, builds by default: 64 bits, md5
+// keeping the trailing bytes of the digest, the lowercase and word
+// character pipeline and shingles of 4 characters. The bit order and the tie
+// break, a bit is set only with more than half of the weight, already match.
+// Two differences remain otherwise, both handled here: Python lowercases a
+// word final Σ to ς rather than σ, and it builds text without shingles from
+// the empty shingle rather than leaving the fingerprint zero. Options that
+// have no Python counterpart are reset, later options still apply on top.
+func WithPythonCompat() Option {
+	return func(s *Simhash) {
+		WithF(64)(s)
+		WithHashFunc(defaultHashFunc)(s)
+		s.Reg = pythonReg
+		s.pipeline = []Step{pythonLowercaseStep, RegexStep}
+		s.shingleWidth = defaultShingleWidth
+		s.fold = false
+		s.padding = 0
+		s.raw = false
+		s.words = false
+		s.stripDiacritics = false
+		s.transpositions = false
+		s.subLinear = false
+		s.featureNormalizer = nil
+		s.shingleWeightCap = 0
+		s.positional = nil
+		s.separator = ""
+		s.hashEmpty = true
+		s.byteSelection = HashBytesTrailing
 	}
-	return bitArray
 }
 
-func sumHashes(digests [][]byte, f int) []int {
-	bitMatrix := make([][]int, len(digests))
-	for i, d := range digests {
-		bitMatrix[i] = bitArrayFromBytes(d)
+// pythonLowercaseStep lowercases like Python's str.lower, which applies the
+// Final_Sigma rule: Σ becomes ς when it ends a word, preceded by a cased
+// letter and not followed by one, skipping case ignorable characters
+func pythonLowercaseStep(_ *Simhash, content string) string {
+	if !strings.ContainsRune(content, 'Σ') {
+		return strings.ToLower(content)
 	}
-	summed := make([]int, f)
-	for _, bits := range bitMatrix {
-		for i := range f {
-			summed[i] += bits[i]
+	runes := []rune(content)
+	var b strings.Builder
+	b.Grow(len(content))
+	for i, r := range runes {
+		if r == 'Σ' && finalSigma(runes, i) {
+			b.WriteRune('ς')
+		} else {
+			b.WriteRune(unicode.ToLower(r))
 		}
 	}
-	return summed
+	return b.String()
 }
 
-func sumHashesBytes(sums [][]int) []int {
-	if len(sums) == 0 {
-		return nil
+func finalSigma(runes []rune, i int) bool {
+	cased := func(r rune) bool {
+		return unicode.IsUpper(r) || unicode.IsLower(r) || unicode.IsTitle(r)
 	}
-	f := len(sums[0])
-	total := make([]int, f)
-	for _, row := range sums {
-		for i := range f {
-			total[i] += row[i]
-		}
+	ignorable := func(r rune) bool {
+		return unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf, unicode.Lm, unicode.Sk) ||
+			strings.ContainsRune("'.:·’", r)
 	}
-	return total
-}
 
-func packBits(bits []int) []byte {
-	n := (len(bits) + 7) / 8
-	result := make([]byte, n)
-	for i, bit := range bits {
-		if bit != 0 {
-			byteIndex := i / 8
-			bitIndex := 7 - (i % 8)
-			result[byteIndex] |= 1 << bitIndex
-		}
+	before := i - 1
+	for before >= 0 && ignorable(runes[before]) {
+		before--
 	}
-	return result
+	if before < 0 || !cased(runes[before]) {
+		return false
+	}
+	after := i + 1
+	for after < len(runes) && ignorable(runes[after]) {
+		after++
+	}
+	return after == len(runes) || !cased(runes[after])
 }
 
-// Find the distance between two simhashes
-func (s *Simhash) Distance(other *Simhash) int {
-	if s.F != other.F {
-		panic("simhashes must have same dimensions")
+// WithRawText skips the normalization pipeline, and diacritic stripping, for
+// text that was already normalized upstream, shingling the input as is. In
+// word mode the words are still found with the regex.
+func WithRawText() Option {
+	return func(s *Simhash) {
+		s.raw = true
 	}
+}
 
-	xor := new(big.Int).Xor(s.Value, other.Value)
+// WithStripDiacritics folds accented letters to their base letter before the
+// pipeline runs, so "José" and "Jose" fingerprint the same. See
+// StripDiacriticsStep for what is folded.
+func WithStripDiacritics() Option {
+	return func(s *Simhash) {
+		s.stripDiacritics = true
+	}
+}
 
-	mask := new(big.Int).Lsh(big.NewInt(1), uint(s.F))
-	mask.Sub(mask, big.NewInt(1))
-	xor.And(xor, mask)
+// WithSubLinearWeights damps feature weights to 1 + ln(weight) before
+// voting, so heavily repeated tokens no longer swamp rare ones. Subtract
+// damps the weights it is given the same way, so it only exactly undoes
+// features that are removed with their full weight.
+func WithSubLinearWeights() Option {
+	return func(s *Simhash) {
+		s.subLinear = true
+	}
+}
 
-	count := 0
-	for xor.Sign() > 0 {
-		count++
-		temp := new(big.Int).Sub(xor, big.NewInt(1))
-		xor.And(xor, temp)
+// WithFeatureNormalizer applies fn to every feature before it is hashed,
+// adding up the weights of features that normalize to the same key. Text is
+// already lowercased by the default pipeline, so passing strings.ToLower
+// makes map and slice inputs consistent with the text path. The default
+// leaves features untouched.
+func WithFeatureNormalizer(fn func(string) string) Option {
+	return func(s *Simhash) {
+		s.featureNormalizer = fn
 	}
+}
 
-	return count
+// WithTranspositionShingles also emits, for every character shingle, a
+// variant with its characters sorted, so shingles that only differ by
+// swapped characters such as "teh " and "the " share a feature. This raises
+// recall for typo-heavy text but lowers precision, as any shingles made of
+// the same characters in a different order now partly match.
+func WithTranspositionShingles() Option {
+	return func(s *Simhash) {
+		s.transpositions = true
+	}
 }
 
-// """
-// `objs` is a list of (obj_id, simhash)
-// obj_id is a string, simhash is an instance of Simhash
-// `f` is the same with the one for Simhash
-// `k` is the tolerance
-// """
-type Object struct {
-	ObjectId string
-	S        *Simhash
+// WithWordTokenizer makes text builds use every regex match as a feature,
+// weighted by its number of occurrences, instead of character shingles of
+// the joined matches. Each word goes through the normalization pipeline.
+func WithWordTokenizer() Option {
+	return func(s *Simhash) {
+		s.words = true
+	}
 }
 
-type IndexOptions func(*SimhashIndex)
+// SubtokenRules selects where WithSubtokenSplit splits words, the rules can
+// be combined
+type SubtokenRules int
+
+const (
+	// SplitCaseChange splits camelCase and PascalCase words, keeping
+	// acronyms together: "parseHTTPHeader" gives parse, HTTP and Header
+	SplitCaseChange SubtokenRules = 1 << iota
+	// SplitHyphen splits on hyphens, for patterns that match them
+	SplitHyphen
+	// SplitUnderscore splits on underscores
+	SplitUnderscore
+)
 
-func SimhashIndexWithF(f int) IndexOptions {
-	return func(s *SimhashIndex) {
-		s.F = f
+// WithSubtokenSplit further splits the words of WithWordTokenizer by rules
+// before they are normalized and counted, so "fooBar-baz" yields foo, bar
+// and baz. Case changes are found on the original text, before lowercasing.
+func WithSubtokenSplit(rules SubtokenRules) Option {
+	return func(s *Simhash) {
+		s.subtokenRules = rules
 	}
 }
 
-func SimhashIndexWithK(k int) IndexOptions {
-	return func(s *SimhashIndex) {
-		s.K = k
+// WithMinShingles makes AddText reject, with ErrTooFewShingles, text that
+// produces fewer than n shingles, whose fingerprint is too unreliable to
+// index. Text that normalizes to nothing has no shingles. NewSimhash itself
+// ignores the option.
+func WithMinShingles(n int) Option {
+	return func(s *Simhash) {
+		s.minShingles = n
 	}
 }
 
-func SimhashIndexWithLog(log *slog.Logger) IndexOptions {
-	return func(s *SimhashIndex) {
-		s.Log = log
+// WithShortTextFallback keeps the normalized text of documents with fewer
+// than threshold distinct features, for which a simhash is unreliable.
+// Distance and WithinDistance between two such documents use their edit
+// distance, as a fraction of the longer text scaled to F bits, instead of
+// the fingerprint bits. A short document compared with a long one, or with
+// one built without the option, still uses the bits, so the measure depends
+// on both sides. Index lookups always use the bits.
+func WithShortTextFallback(threshold int) Option {
+	return func(s *Simhash) {
+		s.shortTextThreshold = threshold
 	}
 }
 
-type SimhashIndex struct {
-	K      int
-	F      int
-	Log    *slog.Logger
-	Bucket map[string]map[string]string
+// WithWeightOverride makes a token repeated in a []WeightedFeature take the
+// weight of its last occurrence instead of the sum of all of them
+func WithWeightOverride() Option {
+	return func(s *Simhash) {
+		s.weightOverride = true
+	}
 }
 
-func NewSimhashIndex(objs []Object, ixOpt ...IndexOptions) *SimhashIndex {
-	s := &SimhashIndex{
-		K:      defaultK,
-		F:      defaultF,
-		Log:    defaultLogger,
-		Bucket: map[string]map[string]string{},
+// WithRetainFeatures keeps the feature map the fingerprint was built from,
+// available through Features. It is opt-in because of the memory cost.
+func WithRetainFeatures() Option {
+	return func(s *Simhash) {
+		s.retainFeatures = true
 	}
+}
+
+func (s *Simhash) Equal(s2 *Simhash) bool {
+	return s.Value.Cmp(s2.Value) == 0
+}
+
+// EqualConstantTime reports whether s and other are the same fingerprint of
+// the same F, in time depending only on the F of s, for equality checks
+// that must not leak timing. Differing dimensions are still compared in full
+// and then rejected.
+func (s *Simhash) EqualConstantTime(other *Simhash) bool {
+	a, b := s.Bytes(), other.Bytes()
+	if len(b) != len(a) {
+		b = make([]byte, len(a))
+	}
+	same := subtle.ConstantTimeCompare(a, b) & subtle.ConstantTimeEq(int32(s.F), int32(other.F))
+	return same == 1
+}
+
+// Bytes returns the fingerprint as a big-endian slice of exactly FBytes bytes
+func (s *Simhash) Bytes() []byte {
+	v := new(big.Int).And(s.Value, fMask(s.F))
+	return v.FillBytes(make([]byte, s.F/8))
+}
+
+// Hex returns the fingerprint as lowercase hex, zero padded to F/4 characters
+func (s *Simhash) Hex() string {
+	return hex.EncodeToString(s.Bytes())
+}
+
+// StringFormat controls how String renders a fingerprint, the flags can be
+// combined and the zero value is plain lowercase hex as returned by Hex
+type StringFormat int
+
+const (
+	// FormatPrefix prepends 0x
+	FormatPrefix StringFormat = 1 << iota
+	// FormatUpper uses uppercase hex digits
+	FormatUpper
+	// FormatGrouped separates every byte with a colon
+	FormatGrouped
+)
+
+// WithStringFormat sets how String renders the fingerprint
+func WithStringFormat(format StringFormat) Option {
+	return func(s *Simhash) {
+		s.stringFormat = format
+	}
+}
+
+// String renders the fingerprint as zero padded hex in the format set with
+// WithStringFormat
+func (s *Simhash) String() string {
+	str := s.Hex()
+	if s.stringFormat&FormatUpper != 0 {
+		str = strings.ToUpper(str)
+	}
+	if s.stringFormat&FormatGrouped != 0 {
+		groups := make([]string, 0, len(str)/2)
+		for i := 0; i < len(str); i += 2 {
+			groups = append(groups, str[i:i+2])
+		}
+		str = strings.Join(groups, ":")
+	}
+	if s.stringFormat&FormatPrefix != 0 {
+		str = "0x" + str
+	}
+	return str
+}
+
+// NewSimhashFromHex builds a Simhash of dimension f from a hex string such as
+// the one returned by Hex
+func NewSimhashFromHex(str string, f int) (*Simhash, error) {
+	value, ok := new(big.Int).SetString(str, 16)
+	if !ok || value.Sign() < 0 {
+		return nil, fmt.Errorf("invalid hex fingerprint %q", str)
+	}
+	if value.BitLen() > f {
+		return nil, fmt.Errorf("hex fingerprint %q does not fit in f %d", str, f)
+	}
+	return NewSimhashErr(value, WithF(f))
+}
+
+// Base64 returns the fixed-width Bytes as unpadded URL-safe base64, two
+// thirds the length of Hex, safe to use in URLs and headers
+func (s *Simhash) Base64() string {
+	return base64.RawURLEncoding.EncodeToString(s.Bytes())
+}
+
+// NewSimhashFromBase64 builds a Simhash of dimension f from a string returned
+// by Base64
+func NewSimhashFromBase64(str string, f int) (*Simhash, error) {
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 fingerprint %q: %w", str, err)
+	}
+	if f <= 0 || len(data) != f/8 {
+		return nil, fmt.Errorf("expected %d bytes for f %d, got %d", f/8, f, len(data))
+	}
+	return NewSimhashErr(new(big.Int).SetBytes(data), WithF(f))
+}
+
+// Words returns the fingerprint as ceil(F/64) uint64 words, least
+// significant word first
+func (s *Simhash) Words() []uint64 {
+	b := s.Bytes()
+	words := make([]uint64, (s.F+63)/64)
+	for i := range words {
+		end := len(b) - i*8
+		start := max(end-8, 0)
+		for _, c := range b[start:end] {
+			words[i] = words[i]<<8 | uint64(c)
+		}
+	}
+	return words
+}
+
+// NewSimhashFromWords builds a Simhash of dimension f from words in the
+// layout returned by Words, bits beyond f are dropped and missing words are
+// zero. An invalid f is logged and reset to the default, like NewSimhash.
+func NewSimhashFromWords(words []uint64, f int) *Simhash {
+	if f%8 != 0 || f <= 0 {
+		defaultLogger.Error("f should be a multiple of 8 and not zero\ngot", "f:", f)
+		f = defaultF
+	}
+	b := make([]byte, len(words)*8)
+	for i, w := range words {
+		binary.BigEndian.PutUint64(b[len(b)-(i+1)*8:], w)
+	}
+	value := new(big.Int).SetBytes(b)
+	return NewSimhash(value.And(value, fMask(f)), WithF(f))
+}
+
+// GobEncode encodes F followed by the fixed-width fingerprint
+func (s *Simhash) GobEncode() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(s.F))
+	return append(buf, s.Bytes()...), nil
+}
+
+// GobDecode restores a Simhash written by GobEncode, options other than F
+// are reset to their defaults
+func (s *Simhash) GobDecode(data []byte) error {
+	f, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errors.New("invalid gob data for simhash")
+	}
+	if f == 0 || f%8 != 0 || uint64(len(data)-n) != f/8 {
+		return fmt.Errorf("invalid gob data for simhash with f %d", f)
+	}
+	*s = *NewSimhash(new(big.Int).SetBytes(data[n:]), WithF(int(f)))
+	return nil
+}
+
+// ToProto returns F and the fixed-width fingerprint bytes, ready to be set
+// on an int32 and a bytes field of a protobuf message
+func (s *Simhash) ToProto() (f int32, data []byte) {
+	return int32(s.F), s.Bytes()
+}
+
+// FromProto rebuilds a Simhash from the values returned by ToProto
+func FromProto(f int32, data []byte) (*Simhash, error) {
+	if f <= 0 || f%8 != 0 {
+		return nil, fmt.Errorf("f should be a multiple of 8 and not zero, got %d", f)
+	}
+	if len(data) != int(f/8) {
+		return nil, fmt.Errorf("expected %d bytes for f %d, got %d", f/8, f, len(data))
+	}
+	return NewSimhashErr(new(big.Int).SetBytes(data), WithF(int(f)))
+}
+
+// slide splits content into overlapping windows of width runes, content
+// shorter than width is kept whole as a single shingle
+func (s *Simhash) slide(content string, width int) []string {
+	// byte offset of every rune start, plus the end of the content
+	starts := make([]int, 0, len(content)+1)
+	for i := range content {
+		starts = append(starts, i)
+	}
+	runes := len(starts)
+	starts = append(starts, len(content))
+
+	if runes < width {
+		return []string{content}
+	}
+
+	result := make([]string, 0, runes-width+1)
+	for i := 0; i <= runes-width; i++ {
+		result = append(result, content[starts[i]:starts[i+width]])
+	}
+	return result
+}
+
+// Step is one stage of the text normalization pipeline run before shingling
+type Step func(s *Simhash, content string) string
+
+// LowercaseStep lowercases the content
+func LowercaseStep(_ *Simhash, content string) string {
+	return strings.ToLower(content)
+}
+
+// RegexStep keeps only the matches of the Simhash's Reg, joined together,
+// or separated by a single space with WithWhitespaceNormalization
+func RegexStep(s *Simhash, content string) string {
+	return strings.Join(s.Reg.FindAllString(content, -1), s.separator)
+}
+
+// StripDiacriticsStep removes combining marks and folds the precomposed
+// letters of Latin-1 Supplement and Latin Extended-A that canonically
+// decompose into a base letter plus marks, which is NFD followed by mark
+// removal for those ranges. Letters without a decomposition, such as ø or ł,
+// are kept.
+func StripDiacriticsStep(_ *Simhash, content string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		if base, ok := diacriticBase[r]; ok {
+			return base
+		}
+		return r
+	}, content)
+}
+
+// diacriticBase maps precomposed letters to their base letter
+var diacriticBase = func() map[rune]rune {
+	variants := map[rune]string{
+		'A': "ÀÁÂÃÄÅĀĂĄ", 'a': "àáâãäåāăą",
+		'C': "ÇĆĈĊČ", 'c': "çćĉċč",
+		'D': "Ď", 'd': "ď",
+		'E': "ÈÉÊËĒĔĖĘĚ", 'e': "èéêëēĕėęě",
+		'G': "ĜĞĠĢ", 'g': "ĝğġģ",
+		'H': "Ĥ", 'h': "ĥ",
+		'I': "ÌÍÎÏĨĪĬĮİ", 'i': "ìíîïĩīĭį",
+		'J': "Ĵ", 'j': "ĵ",
+		'K': "Ķ", 'k': "ķ",
+		'L': "ĹĻĽ", 'l': "ĺļľ",
+		'N': "ÑŃŅŇ", 'n': "ñńņň",
+		'O': "ÒÓÔÕÖŌŎŐ", 'o': "òóôõöōŏő",
+		'R': "ŔŖŘ", 'r': "ŕŗř",
+		'S': "ŚŜŞŠ", 's': "śŝşš",
+		'T': "ŢŤ", 't': "ţť",
+		'U': "ÙÚÛÜŨŪŬŮŰŲ", 'u': "ùúûüũūŭůűų",
+		'W': "Ŵ", 'w': "ŵ",
+		'Y': "ÝŸŶ", 'y': "ýÿŷ",
+		'Z': "ŹŻŽ", 'z': "źżž",
+	}
+	table := make(map[rune]rune)
+	for base, letters := range variants {
+		for _, r := range letters {
+			table[r] = base
+		}
+	}
+	return table
+}()
+
+var defaultPipeline = []Step{LowercaseStep, RegexStep}
+
+func (s *Simhash) normalize(content string) string {
+	if s.raw {
+		return content
+	}
+	pipeline := s.pipeline
+	if pipeline == nil {
+		pipeline = defaultPipeline
+	}
+	if s.stripDiacritics {
+		content = StripDiacriticsStep(s, content)
+	}
+	for _, step := range pipeline {
+		content = step(s, content)
+	}
+	return content
+}
+
+// prepareText cuts content to WithMaxTextBytes and normalizes it, returning
+// the text that is shingled and, with word shingles, the word tokens that
+// text is made of, joined by spaces
+func (s *Simhash) prepareText(content string) (string, []string) {
+	if s.maxTextBytes > 0 && len(content) > s.maxTextBytes {
+		end := s.maxTextBytes
+		for end > 0 && !utf8.RuneStart(content[end]) {
+			end--
+		}
+		content = content[:end]
+	}
+	if s.words {
+		tokens := s.wordTokens(content)
+		return strings.Join(tokens, " "), tokens
+	}
+	return s.normalize(content), nil
+}
+
+func (s *Simhash) tokenize(content string) []string {
+	text, shingles := s.prepareText(content)
+	if !s.words {
+		shingles = s.slide(text, s.shingleWidth)
+	}
+	if s.transpositions {
+		for _, shingle := range shingles[:len(shingles):len(shingles)] {
+			shingles = append(shingles, canonicalShingle(shingle))
+		}
+	}
+	return shingles
+}
+
+// wordTokens returns the normalized regex matches of content, split by the
+// subtoken rules
+func (s *Simhash) wordTokens(content string) []string {
+	var tokens []string
+	for _, word := range s.Reg.FindAllString(content, -1) {
+		for _, sub := range splitSubtokens(word, s.subtokenRules) {
+			if token := s.normalize(sub); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// splitSubtokens splits word on the separators and case changes selected
+// by rules, dropping empty parts
+func splitSubtokens(word string, rules SubtokenRules) []string {
+	if rules == 0 {
+		return []string{word}
+	}
+
+	var parts []string
+	runes := []rune(word)
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if (rules&SplitHyphen != 0 && r == '-') || (rules&SplitUnderscore != 0 && r == '_') {
+			if i > start {
+				parts = append(parts, string(runes[start:i]))
+			}
+			start = i + 1
+			continue
+		}
+		if rules&SplitCaseChange != 0 && i > start && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			// fooBar splits before B, HTTPHeader splits before H of Header
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				parts = append(parts, string(runes[start:i]))
+				start = i
+			}
+		}
+	}
+	if start < len(runes) {
+		parts = append(parts, string(runes[start:]))
+	}
+	return parts
+}
+
+// canonicalShingle returns the shingle's characters sorted, marked so it
+// can't collide with a regular shingle
+func canonicalShingle(shingle string) string {
+	runes := []rune(shingle)
+	slices.Sort(runes)
+	return "\x00" + string(runes)
+}
+
+func (s *Simhash) buildByText(content string) *Simhash {
+	featureMap, shingles := s.countShingles(content)
+	s.shingles = shingles
+	if len(featureMap) < s.shortTextThreshold {
+		s.shortText, _ = s.prepareText(content)
+		s.isShort = true
+	}
+
+	return s.buildByFeatures(featureMap)
+}
+
+// countShingles tokenizes content and weights every shingle by its number
+// of occurrences, capped by the shingle weight cap. It also returns the
+// number of shingles, content that normalizes to nothing having none and so
+// no features.
+func (s *Simhash) countShingles(content string) (map[string]int, int) {
+	tokens := s.tokenize(content)
+	total := len(tokens)
+	if s.transpositions {
+		// the canonical shingles follow the shingles in the same order
+		total /= 2
+	}
+	shingles := total
+	if total == 1 && tokens[0] == "" {
+		shingles = 0
+		if !s.hashEmpty {
+			return map[string]int{}, 0
+		}
+	}
+
+	featureMap := make(map[string]int)
+	var weights map[string]float64
+	if s.positional != nil {
+		weights = make(map[string]float64)
+	}
+	for i, feature := range tokens {
+		if s.shingleWeightCap > 0 && featureMap[feature] >= s.shingleWeightCap {
+			continue
+		}
+		featureMap[feature]++
+		if weights != nil {
+			weights[feature] += s.positional(i%max(total, 1), total)
+		}
+	}
+
+	for feature, weight := range weights {
+		featureMap[feature] = int(math.Round(weight * positionalScale))
+	}
+	return featureMap, shingles
+}
+
+// buildByBytes builds from the byteNgrams wide windows of data, data shorter
+// than a window being a single feature
+func (s *Simhash) buildByBytes(data []byte) *Simhash {
+	featureMap := make(map[string]int)
+	if len(data) < s.byteNgrams {
+		featureMap[string(data)]++
+	}
+	for i := 0; i+s.byteNgrams <= len(data); i++ {
+		featureMap[string(data[i:i+s.byteNgrams])]++
+	}
+	return s.buildByFeatures(featureMap)
+}
+
+// FeatureHash is one feature that votes on a fingerprint, with the weight
+// and the digest bytes it votes with
+type FeatureHash struct {
+	Token  string
+	Weight int
+	Hash   []byte
+}
+
+// DebugFeatures runs content through the same tokenizer and hashing as
+// NewSimhash would with the options of s, and returns every feature with the
+// weight and digest it votes with, sorted by token. It does not modify s.
+func (s *Simhash) DebugFeatures(content string) []FeatureHash {
+	featureMap, _ := s.countShingles(content)
+	featureMap = s.normalizeFeatures(featureMap)
+
+	result := make([]FeatureHash, 0, len(featureMap))
+	for _, token := range slices.Sorted(maps.Keys(featureMap)) {
+		weight := featureMap[token]
+		if s.subLinear {
+			weight = subLinearWeight(weight)
+		}
+		result = append(result, FeatureHash{
+			Token:  token,
+			Weight: weight,
+			Hash:   slices.Clone(s.digest(token)),
+		})
+	}
+	return result
+}
+
+// from python implementation
+//
+// """
+// `features` might be a list of unweighted tokens (a weight of 1
+//
+//	will be assumed), a list of (token, weight) tuples or
+//	a token -> weight dict.
+// """
+// Don't need it since our newSimhash func already handles various input types for value
+
+func (s *Simhash) buildByFeatures(features map[string]int) *Simhash {
+	features = s.normalizeFeatures(features)
+	if s.workers > 1 && len(features) >= concurrentBuildCutoff {
+		s.votes, s.count = s.featureSumsConcurrent(features)
+	} else {
+		s.votes, s.count = s.featureSums(maps.All(features))
+	}
+	if s.retainFeatures {
+		s.features = maps.Clone(features)
+	}
+	s.applyVotes()
+	if len(features) > 0 && s.IsDegenerate() {
+		s.Log.Warn("fingerprint is all zeros or all ones, check the tokenizer", "features", len(features))
+	}
+	return s
+}
+
+// Features returns a copy of the features the fingerprint was built from,
+// or nil unless it was built with WithRetainFeatures
+func (s *Simhash) Features() map[string]int {
+	return maps.Clone(s.features)
+}
+
+// CombineFeatures sums the feature maps retained by hashes, built with
+// WithRetainFeatures, so the combined features can be inspected and built
+// into a single fingerprint. It returns an error naming the first hash that
+// didn't retain its features.
+func CombineFeatures(hashes []*Simhash) (map[string]int, error) {
+	combined := make(map[string]int)
+	for i, h := range hashes {
+		if h.features == nil {
+			return nil, fmt.Errorf("simhash %d did not retain its features, build it with WithRetainFeatures", i)
+		}
+		for feature, weight := range h.features {
+			combined[feature] += weight
+		}
+	}
+	return combined, nil
+}
+
+// normalizeFeatures applies the feature normalizer to every key, adding up
+// the weights of keys that normalize to the same feature
+func (s *Simhash) normalizeFeatures(features map[string]int) map[string]int {
+	if s.featureNormalizer == nil {
+		return features
+	}
+	normalized := make(map[string]int, len(features))
+	for feature, weight := range features {
+		normalized[s.featureNormalizer(feature)] += weight
+	}
+	return normalized
+}
+
+// featureSums returns the weighted bit votes of features and their total weight
+func (s *Simhash) featureSums(features iter.Seq2[string, int]) ([]int, int) {
+	return s.digestSums(func(yield func([]byte, int) bool) {
+		for feature, weight := range features {
+			if s.subLinear {
+				weight = subLinearWeight(weight)
+			}
+			if !yield(s.digest(feature), weight) {
+				return
+			}
+		}
+	})
+}
+
+// digestSums returns the weighted bit votes of FBytes long digests and
+// their total absolute weight. A digest with a positive weight votes for
+// its set bits, one with a negative weight votes with the absolute weight
+// for its unset bits instead, as if its digest were inverted. A bit ends up
+// set when its votes exceed half the total, so in signed terms a feature
+// adds its weight to the bits its digest sets and subtracts it from the
+// others, and a bit is set when its sum is positive.
+func (s *Simhash) digestSums(digests iter.Seq2[[]byte, int]) ([]int, int) {
+	votes := make([]int, s.F)
+	count := 0
+
+	for h, weight := range digests {
+		inverted := weight < 0
+		if inverted {
+			weight = -weight
+		}
+		count += weight
+		if weight == 0 {
+			continue
+		}
+		for i, b := range h[:s.FBytes] {
+			for j := range 8 {
+				if (b&(0x80>>j) != 0) != inverted {
+					votes[i*8+j] += weight
+				}
+			}
+		}
+	}
+
+	return votes, count
+}
+
+// Fingerprint builds a Simhash of dimension f by voting with precomputed
+// digests, bypassing tokenization and hashing. Each digest votes with its
+// trailing f/8 bytes and the matching weight, a nil weights slice giving
+// every digest a weight of 1. It returns nil if f is invalid, the lengths of
+// digests and weights differ or a digest is shorter than f/8 bytes.
+func Fingerprint(digests [][]byte, weights []int, f int) *Simhash {
+	if f <= 0 || f%8 != 0 || (weights != nil && len(weights) != len(digests)) {
+		return nil
+	}
+	for _, d := range digests {
+		if len(d) < f/8 {
+			return nil
+		}
+	}
+
+	s := newSimhash(WithF(f))
+	s.votes, s.count = s.digestSums(func(yield func([]byte, int) bool) {
+		for i, d := range digests {
+			weight := 1
+			if weights != nil {
+				weight = weights[i]
+			}
+			if !yield(d[len(d)-s.FBytes:], weight) {
+				return
+			}
+		}
+	})
+	s.applyVotes()
+	return s
+}
+
+// BuildBoth builds a Simhash from features with both the sequential and the
+// concurrent summing paths, whatever the size of features, and returns an
+// error if they disagree. It is meant for CI checks of custom options, a
+// regular build only takes one of the paths.
+func BuildBoth(features map[string]int, options ...Option) (*Simhash, error) {
+	sequential, err := NewSimhashErr(int64(0), options...)
+	if err != nil {
+		return nil, err
+	}
+	concurrent, _ := NewSimhashErr(int64(0), options...)
+	concurrent.workers = max(concurrent.workers, 2)
+
+	features = sequential.normalizeFeatures(features)
+	sequential.votes, sequential.count = sequential.featureSums(maps.All(features))
+	sequential.applyVotes()
+	concurrent.votes, concurrent.count = concurrent.featureSumsConcurrent(features)
+	concurrent.applyVotes()
+
+	if sequential.count != concurrent.count || !slices.Equal(sequential.votes, concurrent.votes) {
+		return nil, fmt.Errorf("sequential and concurrent builds disagree: %s != %s", sequential, concurrent)
+	}
+	return sequential, nil
+}
+
+// featureSumsConcurrent splits features across the workers and adds up their
+// partial votes, which gives the same result as featureSums
+func (s *Simhash) featureSumsConcurrent(features map[string]int) ([]int, int) {
+	keys := slices.Collect(maps.Keys(features))
+	workers := max(min(s.workers, len(keys)), 1)
+	chunk := (len(keys) + workers - 1) / workers
+
+	votes := make([][]int, workers)
+	counts := make([]int, workers)
+	var wg sync.WaitGroup
+	for w := range workers {
+		part := keys[min(w*chunk, len(keys)):min((w+1)*chunk, len(keys))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			votes[w], counts[w] = s.featureSums(func(yield func(string, int) bool) {
+				for _, key := range part {
+					if !yield(key, features[key]) {
+						return
+					}
+				}
+			})
+		}()
+	}
+	wg.Wait()
+
+	count := 0
+	for _, c := range counts {
+		count += c
+	}
+	return sumHashesBytes(votes), count
+}
+
+// subLinearWeight damps a weight to 1 + ln(weight), scaled by
+// subLinearScale and rounded to keep it an integer vote. Negative weights
+// are damped by their absolute value and keep their sign.
+func subLinearWeight(weight int) int {
+	if weight < 0 {
+		return -subLinearWeight(-weight)
+	}
+	if weight == 0 {
+		return 0
+	}
+	return int(math.Round(subLinearScale * (1 + math.Log(float64(weight)))))
+}
+
+// digest hashes a feature and returns the FBytes that vote on the bits
+func (s *Simhash) digest(feature string) []byte {
+	hashed := s.hash(feature)
+	if s.folds() {
+		return s.foldDigest(hashed)
+	}
+	if len(hashed) < s.FBytes && s.padding != 0 {
+		return s.padDigest(hashed)
+	}
+	if s.byteSelection == HashBytesLeading {
+		return hashed[:s.FBytes]
+	}
+	return hashed[len(hashed)-s.FBytes:]
+}
+
+// folds reports whether hash outputs are folded, by WithFold or by the
+// HashBytesFold selection
+func (s *Simhash) folds() bool {
+	return s.fold || s.byteSelection == HashBytesFold
+}
+
+// padDigest extends a hash output shorter than FBytes as set by
+// WithHashPadding
+func (s *Simhash) padDigest(hashed []byte) []byte {
+	out := make([]byte, 0, s.FBytes)
+	switch s.padding {
+	case HashPadZero:
+		out = append(out[:s.FBytes-len(hashed)], hashed...)
+	case HashPadRepeat:
+		for len(hashed) > 0 && len(out) < s.FBytes {
+			out = append(out, hashed[:min(len(hashed), s.FBytes-len(out))]...)
+		}
+		out = out[:s.FBytes]
+	case HashPadCounter:
+		out = append(out, hashed...)
+		for i := 1; len(out) < s.FBytes; i++ {
+			out = append(out, s.HashFunc(binary.AppendUvarint(slices.Clip(hashed), uint64(i)))...)
+		}
+		out = out[:s.FBytes]
+	}
+	return out
+}
+
+// hash returns the HashFunc output for feature, going through the hash cache if set
+func (s *Simhash) hash(feature string) []byte {
+	if s.hashCache == nil {
+		return s.HashFunc([]byte(feature))
+	}
+	if hashed, ok := s.hashCache.Get(feature); ok {
+		return hashed
+	}
+	hashed := s.HashFunc([]byte(feature))
+	s.hashCache.Put(feature, hashed)
+	return hashed
+}
+
+func (s *Simhash) foldDigest(hashed []byte) []byte {
+	out := make([]byte, s.FBytes)
+	if len(hashed) == 0 {
+		return out
+	}
+
+	long := hashed
+	for prev := hashed; len(long) < s.FBytes; {
+		prev = s.HashFunc(prev)
+		long = append(long[:len(long):len(long)], prev...)
+	}
+	for i, b := range long {
+		out[i%s.FBytes] ^= b
+	}
+	return out
+}
+
+// applyVotes sets Value from the stored votes, a bit is set when more than
+// half of the total weight voted for it
+func (s *Simhash) applyVotes() {
+	finalBits := make([]int, len(s.votes))
+	for i, val := range s.votes {
+		if val > s.count/2 {
+			finalBits[i] = 1
+		}
+	}
+
+	s.Value.SetBytes(packBits(finalBits))
+}
+
+// Subtract removes the contribution of features from a Simhash built from
+// text or features, as if they had never been part of the input, and
+// recomputes the fingerprint.
+func (s *Simhash) Subtract(features map[string]int) error {
+	if s.votes == nil {
+		return errors.New("simhash was not built from features, no votes to subtract from")
+	}
+
+	features = s.normalizeFeatures(features)
+	sums, count := s.featureSums(maps.All(features))
+	if count > s.count {
+		return fmt.Errorf("subtracting weight %d would make total weight %d negative", count, s.count-count)
+	}
+
+	for i := range s.votes {
+		s.votes[i] -= sums[i]
+	}
+	s.count -= count
+	if s.features != nil {
+		for feature, weight := range features {
+			s.features[feature] -= weight
+			if s.features[feature] <= 0 {
+				delete(s.features, feature)
+			}
+		}
+	}
+	s.applyVotes()
+	return nil
+}
+
+func sumHashesBytes(sums [][]int) []int {
+	if len(sums) == 0 {
+		return nil
+	}
+	f := len(sums[0])
+	total := make([]int, f)
+	for _, row := range sums {
+		for i := range f {
+			total[i] += row[i]
+		}
+	}
+	return total
+}
+
+func packBits(bits []int) []byte {
+	n := (len(bits) + 7) / 8
+	result := make([]byte, n)
+	for i, bit := range bits {
+		if bit != 0 {
+			byteIndex := i / 8
+			bitIndex := 7 - (i % 8)
+			result[byteIndex] |= 1 << bitIndex
+		}
+	}
+	return result
+}
+
+// Find the distance between two simhashes
+func (s *Simhash) Distance(other *Simhash) int {
+	if s.F != other.F {
+		panic("simhashes must have same dimensions")
+	}
+	if s.isShort && other.isShort {
+		return s.shortTextDistance(other)
+	}
+
+	xor := new(big.Int).Xor(s.Value, other.Value)
+	xor.And(xor, fMask(s.F))
+
+	count := 0
+	for xor.Sign() > 0 {
+		count++
+		temp := new(big.Int).Sub(xor, big.NewInt(1))
+		xor.And(xor, temp)
+	}
+
+	return count
+}
+
+// shortTextDistance returns the edit distance between the short texts as a
+// fraction of the longer one, scaled to F bits
+func (s *Simhash) shortTextDistance(other *Simhash) int {
+	a, b := []rune(s.shortText), []rune(other.shortText)
+	longest := max(len(a), len(b))
+	if longest == 0 {
+		return 0
+	}
+	return int(math.Round(float64(editDistance(a, b)) / float64(longest) * float64(s.F)))
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// DistanceMasked is like Distance but ignores the bits set in mask, as
+// SimhashIndexWithIgnoreMask does
+func (s *Simhash) DistanceMasked(other *Simhash, mask *big.Int) int {
+	if s.F != other.F {
+		panic("simhashes must have same dimensions")
+	}
+	xor := new(big.Int).Xor(s.Value, other.Value)
+	xor.AndNot(xor, mask)
+	return (&Simhash{F: s.F, Value: xor}).popCount()
+}
+
+// DistanceExcluding is like Distance but ignores the given bit positions,
+// numbered from the least significant bit like BitEntropy, so the noisy
+// positions it finds can be passed straight in. Positions must be within
+// [0, F), otherwise DistanceExcluding panics.
+func (s *Simhash) DistanceExcluding(other *Simhash, positions []int) int {
+	mask := new(big.Int)
+	for _, pos := range positions {
+		if pos < 0 || pos >= s.F {
+			panic(fmt.Sprintf("excluded position %d out of range [0, %d)", pos, s.F))
+		}
+		mask.SetBit(mask, pos, 1)
+	}
+	return s.DistanceMasked(other, mask)
+}
+
+// DistanceToU64 returns the distance to a 64-bit fingerprint held as a plain
+// uint64, without allocating. It panics unless F is 64.
+func (s *Simhash) DistanceToU64(v uint64) int {
+	if s.F != 64 {
+		panic("simhashes must have same dimensions")
+	}
+	return bits.OnesCount64(s.uint64() ^ v)
+}
+
+// uint64 returns the low 64 bits of Value
+func (s *Simhash) uint64() uint64 {
+	if s.Value.BitLen() <= 64 {
+		return s.Value.Uint64()
+	}
+	return new(big.Int).And(s.Value, fMask(64)).Uint64()
+}
+
+// Sample returns the value whose bit j is the bit of s at positions[j],
+// usable as a bit sampling LSH key. Positions count from the least
+// significant bit and must be within [0, F), otherwise Sample panics.
+func (s *Simhash) Sample(positions []int) *big.Int {
+	key := new(big.Int)
+	for j, pos := range positions {
+		if pos < 0 || pos >= s.F {
+			panic(fmt.Sprintf("sample position %d out of range [0, %d)", pos, s.F))
+		}
+		key.SetBit(key, j, s.Value.Bit(pos))
+	}
+	return key
+}
+
+// ApproxDistance estimates Distance from sampleBits evenly spaced bit
+// positions, the same for every pair, scaling the differing samples to F,
+// as a cheap pre-filter before the exact distance. Out of d differing bits
+// spread at random, the estimate has a mean of d and a variance of
+// d(F-d)/sampleBits * (F-sampleBits)/(F-1), so at F 64 and d 8 a sample
+// of 16 bits has a standard deviation of about 4.6 bits. A sampleBits
+// outside of (0, F) gives the exact Distance.
+func (s *Simhash) ApproxDistance(other *Simhash, sampleBits int) int {
+	if s.F != other.F {
+		panic("simhashes must have same dimensions")
+	}
+	if sampleBits <= 0 || sampleBits >= s.F {
+		return s.Distance(other)
+	}
+
+	differing := 0
+	for j := range sampleBits {
+		pos := j * s.F / sampleBits
+		differing += int(s.Value.Bit(pos) ^ other.Value.Bit(pos))
+	}
+	return (differing*s.F + sampleBits/2) / sampleBits
+}
+
+// popCount returns the number of set bits among the low F bits
+func (s *Simhash) popCount() int {
+	v := new(big.Int).And(s.Value, fMask(s.F))
+	count := 0
+	for _, w := range v.Bits() {
+		count += bits.OnesCount(uint(w))
+	}
+	return count
+}
+
+// PopCount returns the number of set bits among the low F bits
+func (s *Simhash) PopCount() int {
+	return s.popCount()
+}
+
+// Xor returns the difference fingerprint of s and other, a new Simhash of
+// the same F with a bit set wherever they differ, so its PopCount is their
+// Distance outside of the short text fallback. It returns
+// ErrDimensionMismatch when their dimensions differ.
+func (s *Simhash) Xor(other *Simhash) (*Simhash, error) {
+	if s.F != other.F {
+		return nil, fmt.Errorf("%w: %d and %d", ErrDimensionMismatch, s.F, other.F)
+	}
+	x := newSimhash(WithF(s.F), WithLogger(s.Log))
+	x.Value.Xor(s.Value, other.Value)
+	x.Value.And(x.Value, fMask(s.F))
+	return x, nil
+}
+
+// IsZero reports whether the low F bits are all zeros, as for text that
+// normalizes to nothing, such as "" or only punctuation, which has no
+// features to vote
+func (s *Simhash) IsZero() bool {
+	return s.popCount() == 0
+}
+
+// IsDegenerate reports whether the low F bits are all zeros or all ones, as
+// when the features vote unanimously or there are none. Such a fingerprint
+// is near to either nothing or everything that leans the same way.
+func (s *Simhash) IsDegenerate() bool {
+	ones := s.popCount()
+	return ones == 0 || ones == s.F
+}
+
+// Truncate returns a copy of s reduced to its low f bits. When the trailing
+// bytes of each digest are used as is, the default, the low bits come from
+// the trailing bytes and this is the fingerprint building with WithF(f)
+// would have produced. It isn't with WithFold, WithHashPadding or
+// HashBytesLeading, whose digests depend on FBytes.
+func (s *Simhash) Truncate(f int) (*Simhash, error) {
+	if f <= 0 || f%8 != 0 || f > s.F {
+		return nil, fmt.Errorf("cannot truncate f %d to %d", s.F, f)
+	}
+
+	t := *s
+	t.F = f
+	t.FBytes = f / 8
+	t.Value = new(big.Int).And(s.Value, fMask(f))
+	if s.votes != nil {
+		t.votes = slices.Clone(s.votes[len(s.votes)-f:])
+	}
+	t.features = maps.Clone(s.features)
+	return &t, nil
+}
+
+// CompareAcrossF returns the distance between fingerprints of different
+// dimensions by truncating the larger one to the smaller F. It logs a warning
+// when the dimensions differ and errors when they differ by more than a
+// factor of maxFRatio, where most of the larger fingerprint is discarded.
+func CompareAcrossF(a, b *Simhash) (int, error) {
+	if a.F == b.F {
+		return a.Distance(b), nil
+	}
+	if a.F < b.F {
+		a, b = b, a
+	}
+	if a.F > b.F*maxFRatio {
+		return 0, fmt.Errorf("cannot meaningfully compare f %d with f %d", a.F, b.F)
+	}
+	a.Log.Warn("comparing simhashes of different dimensions, truncating", "from", a.F, "to", b.F)
+
+	t, err := a.Truncate(b.F)
+	if err != nil {
+		return 0, err
+	}
+	return t.Distance(b), nil
+}
+
+// WithinDistance reports whether other is at most k bits away, counting the
+// differing bits a machine word at a time and stopping as soon as k is exceeded
+func (s *Simhash) WithinDistance(other *Simhash, k int) bool {
+	_, ok := s.distanceWithin(other, k)
+	return ok
+}
+
+// distanceWithin is WithinDistance that also returns the distance when it is
+// at most k
+func (s *Simhash) distanceWithin(other *Simhash, k int) (int, bool) {
+	if s.F != other.F {
+		panic("simhashes must have same dimensions")
+	}
+	if s.isShort && other.isShort {
+		d := s.shortTextDistance(other)
+		return d, d <= k
+	}
+
+	a, b := s.Value.Bits(), other.Value.Bits()
+	count := 0
+	for i := 0; i*bits.UintSize < s.F; i++ {
+		w := uint(wordAt(a, i) ^ wordAt(b, i))
+		if rem := s.F - i*bits.UintSize; rem < bits.UintSize {
+			w &= 1<<rem - 1
+		}
+		count += bits.OnesCount(w)
+		if count > k {
+			return count, false
+		}
+	}
+	return count, true
+}
+
+// MinRotationDistance returns the smallest Distance between s and other
+// rotated within its F bits by up to maxRot positions in either direction,
+// for comparing with systems that store fingerprints rotated
+func (s *Simhash) MinRotationDistance(other *Simhash, maxRot int) int {
+	if s.F != other.F {
+		panic("simhashes must have same dimensions")
+	}
+
+	mask := fMask(s.F)
+	value := new(big.Int).And(other.Value, mask)
+	rotated := &Simhash{F: s.F, FBytes: s.FBytes, Value: new(big.Int)}
+	best := s.Distance(other)
+	for r := 1; r <= min(maxRot, s.F-1); r++ {
+		// rotating right by r is rotating left by F-r
+		for _, left := range []int{r, s.F - r} {
+			rotated.Value.Lsh(value, uint(left))
+			rotated.Value.Or(rotated.Value, new(big.Int).Rsh(value, uint(s.F-left)))
+			rotated.Value.And(rotated.Value, mask)
+			best = min(best, s.Distance(rotated))
+		}
+	}
+	return best
+}
+
+// wordAt returns the i-th little-endian word of a big.Int's bits, 0 past its end
+func wordAt(words []big.Word, i int) big.Word {
+	if i < len(words) {
+		return words[i]
+	}
+	return 0
+}
+
+// DistanceErr is like Distance but returns an error instead of panicking on
+// mismatched dimensions, and logs a warning when the two fingerprints were
+// built with different hash functions, since their distance is meaningless.
+func (s *Simhash) DistanceErr(other *Simhash) (int, error) {
+	if s.F != other.F {
+		return 0, fmt.Errorf("%w: %d and %d", ErrDimensionMismatch, s.F, other.F)
+	}
+	if s.hashName != "" && other.hashName != "" && s.hashName != other.hashName {
+		s.Log.Warn("comparing simhashes built with different hash functions", "hash", s.hashName, "other", other.hashName)
+	}
+	return s.Distance(other), nil
+}
+
+// DistanceAndOverlap returns DistanceErr along with the Jaccard index of the
+// two retained feature sets, the share of distinct features they have in
+// common, to see where the fingerprint distance and the actual overlap
+// disagree. Both must be built with WithRetainFeatures, two empty feature
+// sets count as identical.
+func (s *Simhash) DistanceAndOverlap(other *Simhash) (dist int, jaccard float64, err error) {
+	if s.features == nil || other.features == nil {
+		return 0, 0, errors.New("simhash did not retain its features, build it with WithRetainFeatures")
+	}
+	dist, err = s.DistanceErr(other)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	common := 0
+	for feature := range s.features {
+		if _, ok := other.features[feature]; ok {
+			common++
+		}
+	}
+	union := len(s.features) + len(other.features) - common
+	if union == 0 {
+		return dist, 1, nil
+	}
+	return dist, float64(common) / float64(union), nil
+}
+
+// Similarity returns 1 - distance/F, 1 meaning identical fingerprints
+func (s *Simhash) Similarity(other *Simhash) float64 {
+	return SimilarityWith(s, other, LinearKernel)
+}
+
+// SimilarityConfidence returns Similarity along with the half width of a
+// rough 95% confidence interval for it. Each of the F bits is treated as an
+// independent trial agreeing with the fraction of bits that agree, and the
+// width is half the Wilson score interval over F trials, so it shrinks like
+// 1/sqrt(F) and stays non-zero for identical fingerprints. Bits of a simhash
+// are not truly independent, so read the interval as a lower bound on the
+// real uncertainty: a distance of 3 means much less at F=64 than at F=1024.
+func (s *Simhash) SimilarityConfidence(other *Simhash) (score float64, within95 float64) {
+	const z = 1.96
+	score = s.Similarity(other)
+	n := float64(s.F)
+	within95 = z / (1 + z*z/n) * math.Sqrt(score*(1-score)/n+z*z/(4*n*n))
+	return score, within95
+}
+
+// SimilarityWith scores a and b by applying kernel to their Hamming distance
+// and their dimension F
+func SimilarityWith(a, b *Simhash, kernel func(d, f int) float64) float64 {
+	return kernel(a.Distance(b), a.F)
+}
+
+// LinearKernel scores 1 - d/f
+func LinearKernel(d, f int) float64 {
+	return 1 - float64(d)/float64(f)
+}
+
+// CosineKernel estimates the cosine similarity of the original feature
+// vectors, cos(pi*d/f), since the fraction of differing simhash bits
+// approximates the angle between them over pi
+func CosineKernel(d, f int) float64 {
+	return math.Cos(math.Pi * float64(d) / float64(f))
+}
+
+// GaussianKernel returns a kernel scoring exp(-d²/σ²)
+func GaussianKernel(sigma float64) func(d, f int) float64 {
+	return func(d, _ int) float64 {
+		return math.Exp(-float64(d*d) / (sigma * sigma))
+	}
+}
+
+// SimilarPairs returns the index pairs (i < j) of hashes whose Similarity is
+// at least threshold, sorted by i then j. All hashes must share the same F.
+// Large inputs are bucketed by index blocks to avoid comparing every pair.
+func SimilarPairs(hashes []*Simhash, threshold float64) [][2]int {
+	if len(hashes) < 2 {
+		return nil
+	}
+	f := hashes[0].F
+	for _, h := range hashes {
+		if h.F != f {
+			panic("simhashes must have same dimensions")
+		}
+	}
+
+	maxDist := int(math.Floor((1 - threshold) * float64(f)))
+	if maxDist < 0 {
+		return nil
+	}
+
+	var pairs [][2]int
+	if len(hashes) < similarPairsIndexCutoff || f/(maxDist+1) < minBlockBits {
+		for i := range hashes {
+			for j := i + 1; j < len(hashes); j++ {
+				if hashes[i].Distance(hashes[j]) <= maxDist {
+					pairs = append(pairs, [2]int{i, j})
+				}
+			}
+		}
+		return pairs
+	}
+
+	blocks := make(map[string][]int)
+	for i, h := range hashes {
+		for _, key := range blockKeys(h, f, maxDist) {
+			blocks[key] = append(blocks[key], i)
+		}
+	}
+
+	seen := make(map[[2]int]struct{})
+	for _, members := range blocks {
+		for x, i := range members {
+			for _, j := range members[x+1:] {
+				pair := [2]int{i, j}
+				if _, ok := seen[pair]; ok {
+					continue
+				}
+				seen[pair] = struct{}{}
+				if hashes[i].Distance(hashes[j]) <= maxDist {
+					pairs = append(pairs, pair)
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(pairs, func(a, b [2]int) int {
+		if a[0] != b[0] {
+			return a[0] - b[0]
+		}
+		return a[1] - b[1]
+	})
+	return pairs
+}
+
+// BitEntropy returns, for each of the F bit positions, the fraction of hashes
+// with that bit set. Position i is bit i of Value, least significant first.
+// A well behaved tokenizer and hash keep every position close to 0.5.
+func BitEntropy(hashes []*Simhash) []float64 {
+	if len(hashes) == 0 {
+		return nil
+	}
+	f := hashes[0].F
+
+	ones := make([]int, f)
+	for _, h := range hashes {
+		if h.F != f {
+			panic("simhashes must have same dimensions")
+		}
+		for i := range f {
+			ones[i] += int(h.Value.Bit(i))
+		}
+	}
+
+	fractions := make([]float64, f)
+	for i, n := range ones {
+		fractions[i] = float64(n) / float64(len(hashes))
+	}
+	return fractions
+}
+
+// masks caches the (1<<f)-1 mask for each dimension f
+var masks sync.Map
+
+// fMask returns the shared mask of the low f bits, it must not be modified
+func fMask(f int) *big.Int {
+	if m, ok := masks.Load(f); ok {
+		return m.(*big.Int)
+	}
+	mask := new(big.Int).Lsh(big.NewInt(1), uint(f))
+	mask.Sub(mask, big.NewInt(1))
+	m, _ := masks.LoadOrStore(f, mask)
+	return m.(*big.Int)
+}
+
+// """
+// `objs` is a list of (obj_id, simhash)
+// obj_id is a string, simhash is an instance of Simhash
+// `f` is the same with the one for Simhash
+// `k` is the tolerance
+// """
+type Object struct {
+	ObjectId string
+	S        *Simhash
+
+	// Tags are optional attributes, such as a tenant or language, that
+	// GetNearDupsFiltered can restrict matches by
+	Tags map[string]string
+}
+
+var (
+	ErrObjectNotFound    = errors.New("object not found in index")
+	ErrDimensionMismatch = errors.New("simhash dimension does not match")
+	ErrTooFewShingles    = errors.New("document has too few shingles to index")
+)
+
+type IndexOptions func(*SimhashIndex)
+
+func SimhashIndexWithF(f int) IndexOptions {
+	return func(s *SimhashIndex) {
+		s.F = f
+	}
+}
+
+func SimhashIndexWithK(k int) IndexOptions {
+	return func(s *SimhashIndex) {
+		s.K = k
+	}
+}
+
+// SimhashIndexWithRecall splits fingerprints into the fewest blocks that
+// still find a duplicate K bits away with at least the given probability,
+// see OptimalBlocksForRecall. Fewer, larger blocks mean fewer candidates to
+// check per query. A recall of 1 keeps the default K+1 blocks.
+func SimhashIndexWithRecall(recall float64) IndexOptions {
+	return func(s *SimhashIndex) {
+		s.recall = recall
+	}
+}
+
+// SimhashIndexWithStrict makes queries check that every matched object id
+// came with a single fingerprint, and log a warning naming the ids that did
+// not. Such ids point at a corrupted index, for example buckets edited by
+// hand or loaded from a bad snapshot, which the id based results would
+// otherwise hide.
+func SimhashIndexWithStrict() IndexOptions {
+	return func(s *SimhashIndex) {
+		s.strict = true
+	}
+}
+
+// SimhashIndexWithIgnoreMask makes the index ignore the fingerprint bits set
+// in mask, for bits coming from fields expected to differ such as version
+// numbers. The bits are cleared from every fingerprint added, deleted or
+// queried, so they affect neither bucketing nor distances, and fingerprints
+// returned by the index have them cleared. All fingerprints must therefore
+// be compared under the same mask, it can't be changed on a built index.
+func SimhashIndexWithIgnoreMask(mask *big.Int) IndexOptions {
+	return func(s *SimhashIndex) {
+		s.ignoreMask = new(big.Int).Set(mask)
+	}
+}
+
+func SimhashIndexWithLog(log *slog.Logger) IndexOptions {
+	return func(s *SimhashIndex) {
+		s.Log = log
+	}
+}
+
+// SimhashIndexWithSortedBuckets keeps every bucket as a slice sorted by the
+// popcount of its fingerprints instead of a map. Since two fingerprints
+// within k bits differ in popcount by at most k, queries binary search the
+// popcount window of each bucket instead of scanning all of it. Results are
+// identical to the default mode.
+//
+// The slices replace the Bucket map, which stays empty. An add or delete
+// shifts the slice of each of its buckets, taking time linear in the bucket
+// size, so the mode suits read heavy indexes.
+func SimhashIndexWithSortedBuckets() IndexOptions {
+	return func(s *SimhashIndex) {
+		s.sorted = map[string][]sortedEntry{}
+	}
+}
+
+type SimhashIndex struct {
+	K      int
+	F      int
+	Log    *slog.Logger
+	Bucket map[string]map[string]string
+
+	// objects tracks the fingerprint currently stored for each object id
+	// and tags the tags it was added with, if any
+	objects map[string]*Simhash
+	tags    map[string]map[string]string
+
+	// exact maps the hex of every tracked fingerprint to the ids holding it
+	exact map[string][]string
+
+	// blocks is the number of blocks fingerprints are split into, 0 meaning
+	// the default K+1
+	blocks int
+	recall float64
+
+	// strict makes queries warn about ids matched with several fingerprints
+	strict bool
+
+	// ignoreMask holds the bits cleared from every fingerprint, nil when
+	// no bit is ignored
+	ignoreMask *big.Int
+
+	// wal receives a record of every change, walBuf is reused to encode them
+	wal    io.Writer
+	walBuf []byte
+
+	// sorted mirrors Bucket as slices ordered by popcount then fingerprint,
+	// it is nil unless SimhashIndexWithSortedBuckets is used
+	sorted map[string][]sortedEntry
+
+	// lifetime counters read by Metrics without taking mu
+	adds, deletes, queries atomic.Uint64
+	objectCount            atomic.Int64
+
+	mu sync.RWMutex
+}
+
+// IndexMetrics holds cumulative counters of a SimhashIndex since it was
+// created, along with its current number of objects
+type IndexMetrics struct {
+	Adds    uint64
+	Deletes uint64
+	Queries uint64
+	Objects int64
+}
+
+// Metrics returns the index counters. Adds and Deletes only count the calls
+// that changed the index, an Update counting as an add. It doesn't take the
+// index lock, so it can be polled under load, and the counters are each read
+// atomically but not as one snapshot.
+func (s *SimhashIndex) Metrics() IndexMetrics {
+	return IndexMetrics{
+		Adds:    s.adds.Load(),
+		Deletes: s.deletes.Load(),
+		Queries: s.queries.Load(),
+		Objects: s.objectCount.Load(),
+	}
+}
+
+// sortedEntry is a bucket entry of an index with sorted buckets, holding
+// the parsed fingerprint rather than its bucketEntry string
+type sortedEntry struct {
+	pop int
+	sim *Simhash
+	id  string
+}
+
+func compareSortedEntries(a, b sortedEntry) int {
+	if a.pop != b.pop {
+		return a.pop - b.pop
+	}
+	if c := a.sim.Value.Cmp(b.sim.Value); c != 0 {
+		return c
+	}
+	return strings.Compare(a.id, b.id)
+}
+
+func NewSimhashIndex(objs []Object, ixOpt ...IndexOptions) *SimhashIndex {
+	s := newIndexConfig(ixOpt...)
+
+	// the default layout, 64 bits in 3 blocks of 21, 21 and 22 bits, is the
+	// one the Python implementation uses and every index made without
+	// options has, so only layouts the caller chose are warned about
+	if blocks := s.numBlocks(); s.F%blocks != 0 && (s.F != defaultF || s.K != defaultK) {
+		s.Log.Warn("f does not split evenly into the index blocks, the last block takes the remainder", "f", s.F, "blocks", blocks, "suggested", evenF(s.F, blocks))
+	}
+
+	for _, obj := range objs {
+		s.Add(obj)
+	}
+
+	return s
+}
+
+// newIndexConfig returns an empty index with ixOpt applied, without the
+// layout warning of NewSimhashIndex, for callers that only need its settings
+func newIndexConfig(ixOpt ...IndexOptions) *SimhashIndex {
+	s := &SimhashIndex{
+		K:       defaultK,
+		F:       defaultF,
+		Log:     defaultLogger,
+		Bucket:  map[string]map[string]string{},
+		objects: map[string]*Simhash{},
+		tags:    map[string]map[string]string{},
+		exact:   map[string][]string{},
+	}
+
+	for _, opt := range ixOpt {
+		opt(s)
+	}
+
+	if s.recall > 0 {
+		s.blocks = OptimalBlocksForRecall(s.F, s.K, s.recall)
+	}
+	return s
+}
 
-	for _, opt := range ixOpt {
-		opt(s)
+// numBlocks returns how many blocks fingerprints are split into
+func (s *SimhashIndex) numBlocks() int {
+	if s.blocks > 0 {
+		return s.blocks
 	}
+	return s.K + 1
+}
 
-	for _, obj := range objs {
-		s.Add(obj)
+// Add inserts obj into the index. An object id maps to a single fingerprint,
+// adding an id that is already indexed with a different fingerprint replaces it.
+func (s *SimhashIndex) Add(obj Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obj.S != nil && obj.S.F == s.F {
+		s.logWAL(walAdd, obj.ObjectId, obj.S, obj.Tags)
+	}
+	if s.add(obj) {
+		s.adds.Add(1)
 	}
+}
 
-	return s
+// AddText fingerprints text with the index's F and adds it under objectID.
+// The options configure the tokenizer like for NewSimhash, an option setting
+// a different F is reported as ErrDimensionMismatch rather than silently
+// indexing a fingerprint no query can find.
+func (s *SimhashIndex) AddText(objectID, text string, options ...Option) error {
+	options = append([]Option{WithF(s.F)}, options...)
+	sim, err := NewSimhashErr(text, options...)
+	if err != nil {
+		return err
+	}
+	if sim.F != s.F {
+		return fmt.Errorf("%w: index has f %d, fingerprint %d", ErrDimensionMismatch, s.F, sim.F)
+	}
+	if sim.shingles < sim.minShingles {
+		return fmt.Errorf("%w: %d of %d", ErrTooFewShingles, sim.shingles, sim.minShingles)
+	}
+	s.Add(Object{ObjectId: objectID, S: sim})
+	return nil
 }
 
-func (s *SimhashIndex) Add(obj Object) {
+// progressSteps is how many times at most AddAllWithProgress reports
+const progressSteps = 100
+
+// AddAllWithProgress adds objs in order like Add, calling report with the
+// number added so far and len(objs) after every hundredth of them and once
+// all are added, so a huge corpus reports about a hundred times rather than
+// per object. The lock is taken per object, queries can run in between, and
+// since done counts from the start of objs an interrupted ingestion can be
+// resumed from objs[done:].
+func (s *SimhashIndex) AddAllWithProgress(objs []Object, report func(done, total int)) {
+	total := len(objs)
+	step := max((total+progressSteps-1)/progressSteps, 1)
+	for i, obj := range objs {
+		s.Add(obj)
+		if done := i + 1; report != nil && (done%step == 0 || done == total) {
+			report(done, total)
+		}
+	}
+}
+
+// add inserts obj and reports whether that changed the index, objects
+// without a fingerprint or of another F are ignored
+func (s *SimhashIndex) add(obj Object) bool {
 	if obj.S == nil || obj.S.F != s.F {
+		return false
+	}
+	sim := bareSimhash(new(big.Int).Set(obj.S.Value), s.F)
+	if s.ignoreMask != nil {
+		sim.Value.AndNot(sim.Value, s.ignoreMask)
+	}
+	old, ok := s.objects[obj.ObjectId]
+	unchanged := ok && old.Equal(sim) && maps.Equal(s.tags[obj.ObjectId], obj.Tags)
+	if ok && !old.Equal(sim) {
+		s.removeEntry(obj.ObjectId, old)
+		s.untrack(obj.ObjectId)
+	}
+	val := bucketEntry(obj.ObjectId, sim)
+	for _, key := range s.keys(sim) {
+		s.putEntry(key, obj.ObjectId, val, sim)
+	}
+	if _, ok := s.objects[obj.ObjectId]; !ok {
+		hex := sim.Hex()
+		s.exact[hex] = append(s.exact[hex], obj.ObjectId)
+	}
+	s.objects[obj.ObjectId] = sim
+	s.objectCount.Store(int64(len(s.objects)))
+	if obj.Tags != nil {
+		s.tags[obj.ObjectId] = maps.Clone(obj.Tags)
+	} else {
+		delete(s.tags, obj.ObjectId)
+	}
+	return !unchanged
+}
+
+func (s *SimhashIndex) putEntry(key, objectID, val string, sim *Simhash) {
+	if s.sorted != nil {
+		entry := sortedEntry{pop: sim.popCount(), sim: sim, id: objectID}
+		entries := s.sorted[key]
+		if i, found := slices.BinarySearchFunc(entries, entry, compareSortedEntries); !found {
+			s.sorted[key] = slices.Insert(entries, i, entry)
+		}
 		return
 	}
-	val := fmt.Sprintf("%x,%s", obj.S.Value, obj.ObjectId)
-	for _, key := range s.GetKeys(obj.S) {
-		if s.Bucket[key] == nil {
-			s.Bucket[key] = make(map[string]string)
+
+	if s.Bucket[key] == nil {
+		s.Bucket[key] = make(map[string]string)
+	}
+	s.Bucket[key][val] = val
+}
+
+// dropEntry removes the entry val of objectID from the bucket key and
+// reports whether it was there
+func (s *SimhashIndex) dropEntry(key, objectID, val string, sim *Simhash) bool {
+	if s.sorted != nil {
+		entries := s.sorted[key]
+		entry := sortedEntry{pop: sim.popCount(), sim: sim, id: objectID}
+		i, found := slices.BinarySearchFunc(entries, entry, compareSortedEntries)
+		if found {
+			entries = slices.Delete(entries, i, i+1)
+		}
+		if len(entries) == 0 {
+			delete(s.sorted, key)
+		} else {
+			s.sorted[key] = entries
+		}
+		return found
+	}
+
+	_, found := s.Bucket[key][val]
+	if _, ok := s.Bucket[key]; ok {
+		delete(s.Bucket[key], val)
+		if len(s.Bucket[key]) == 0 {
+			delete(s.Bucket, key)
+		}
+	}
+	return found
+}
+
+// buckets returns the bucket entries by key, Bucket itself or, with sorted
+// buckets, a copy built from the sorted slices, for read only use
+func (s *SimhashIndex) buckets() map[string]map[string]string {
+	if s.sorted == nil {
+		return s.Bucket
+	}
+	buckets := make(map[string]map[string]string, len(s.sorted))
+	for key, entries := range s.sorted {
+		bucket := make(map[string]string, len(entries))
+		for _, e := range entries {
+			val := bucketEntry(e.id, e.sim)
+			bucket[val] = val
 		}
-		s.Bucket[key][val] = val
+		buckets[key] = bucket
+	}
+	return buckets
+}
+
+// bucketLen returns the number of entries in the bucket key
+func (s *SimhashIndex) bucketLen(key string) int {
+	if s.sorted != nil {
+		return len(s.sorted[key])
+	}
+	return len(s.Bucket[key])
+}
+
+// bucketCount returns the number of buckets
+func (s *SimhashIndex) bucketCount() int {
+	if s.sorted != nil {
+		return len(s.sorted)
 	}
+	return len(s.Bucket)
 }
 
 func (s *SimhashIndex) Delete(obj Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obj.S != nil && obj.S.F == s.F {
+		s.logWAL(walDelete, obj.ObjectId, obj.S, nil)
+	}
+	if s.delete(obj) {
+		s.deletes.Add(1)
+	}
+}
+
+// delete removes obj and reports whether it was indexed
+func (s *SimhashIndex) delete(obj Object) bool {
 	if obj.S == nil || obj.S.F != s.F {
-		return
+		return false
+	}
+	sim := s.masked(obj.S)
+	removed := s.removeEntry(obj.ObjectId, sim)
+	if old, ok := s.objects[obj.ObjectId]; ok && old.Equal(sim) {
+		s.untrack(obj.ObjectId)
+		removed = true
+	}
+	return removed
+}
+
+// DeleteByIDScan removes every bucket entry of objectID, whatever its
+// fingerprint, and returns the number of entries removed. It scans all
+// buckets so it costs O(total entries), but it also cleans up entries left
+// behind by an index that lost track of the id.
+func (s *SimhashIndex) DeleteByIDScan(objectID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logWAL(walDeleteByID, objectID, nil, nil)
+	_, tracked := s.objects[objectID]
+	removed := s.deleteByID(objectID)
+	if removed > 0 || tracked {
+		s.deletes.Add(1)
+	}
+	return removed
+}
+
+func (s *SimhashIndex) deleteByID(objectID string) int {
+	type entry struct {
+		key, val string
+		sim      *Simhash
+	}
+	var found []entry
+	for key, entries := range s.buckets() {
+		for val := range entries {
+			id, sim, ok := parseEntry(val, s.F)
+			if ok && id == objectID {
+				found = append(found, entry{key, val, sim})
+			}
+		}
 	}
-	val := fmt.Sprintf("%x,%s", obj.S.Value, obj.ObjectId)
-	for _, key := range s.GetKeys(obj.S) {
-		if _, ok := s.Bucket[key]; ok {
-			delete(s.Bucket[key], val)
-			if len(s.Bucket[key]) == 0 {
-				delete(s.Bucket, key)
+	for _, e := range found {
+		s.dropEntry(e.key, objectID, e.val, e.sim)
+	}
+	s.untrack(objectID)
+	return len(found)
+}
+
+// DeleteWhere removes every object whose id satisfies pred from all the
+// buckets, dropping the buckets it empties, and returns the number of
+// objects removed. pred is called once per id, with the index locked, so it
+// must not use the index. Each removal is logged to the WAL like a
+// DeleteByIDScan.
+func (s *SimhashIndex) DeleteWhere(pred func(objectID string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type entry struct {
+		key, val string
+		sim      *Simhash
+	}
+	matched := make(map[string]bool)
+	doomed := make(map[string][]entry)
+	for key, entries := range s.buckets() {
+		for val := range entries {
+			id, sim, ok := parseEntry(val, s.F)
+			if !ok {
+				continue
+			}
+			del, seen := matched[id]
+			if !seen {
+				del = pred(id)
+				matched[id] = del
 			}
+			if del {
+				doomed[id] = append(doomed[id], entry{key, val, sim})
+			}
+		}
+	}
+
+	// each object is logged before it is removed, like with Delete
+	for id, entries := range doomed {
+		s.logWAL(walDeleteByID, id, nil, nil)
+		for _, e := range entries {
+			s.dropEntry(e.key, id, e.val, e.sim)
+		}
+		s.untrack(id)
+		s.deletes.Add(1)
+	}
+	return len(doomed)
+}
+
+// removeObject drops the tracked fingerprint of objectID and its bucket entries
+func (s *SimhashIndex) removeObject(objectID string) bool {
+	old, ok := s.objects[objectID]
+	if !ok {
+		return false
+	}
+	s.removeEntry(objectID, old)
+	s.untrack(objectID)
+	return true
+}
+
+// untrack forgets the fingerprint and tags of objectID, leaving its bucket
+// entries alone
+func (s *SimhashIndex) untrack(objectID string) {
+	if old, ok := s.objects[objectID]; ok {
+		hex := old.Hex()
+		ids := slices.DeleteFunc(s.exact[hex], func(id string) bool { return id == objectID })
+		if len(ids) == 0 {
+			delete(s.exact, hex)
+		} else {
+			s.exact[hex] = ids
+		}
+	}
+	delete(s.objects, objectID)
+	delete(s.tags, objectID)
+	s.objectCount.Store(int64(len(s.objects)))
+}
+
+// GetExactDups returns the ids of the objects whose fingerprint is exactly
+// sim, sorted, from a map of fingerprints kept next to the buckets. It is a
+// constant time pre-filter for workloads where most duplicates are exact.
+func (s *SimhashIndex) GetExactDups(sim *Simhash) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if sim.F != s.F {
+		return nil
+	}
+	s.queries.Add(1)
+	ids := slices.Clone(s.exact[s.masked(sim).Hex()])
+	slices.Sort(ids)
+	return ids
+}
+
+// Update replaces the fingerprint stored for objectID with newSim, without
+// the caller having to reconstruct the old fingerprint.
+func (s *SimhashIndex) Update(objectID string, newSim *Simhash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if newSim == nil || newSim.F != s.F {
+		return ErrDimensionMismatch
+	}
+	tags := s.tags[objectID]
+	old, ok := s.objects[objectID]
+	if !ok {
+		return ErrObjectNotFound
+	}
+	if !old.Equal(s.masked(newSim)) {
+		s.adds.Add(1)
+	}
+	s.removeObject(objectID)
+	// adding an indexed id replaces its fingerprint, so this replays Update
+	s.logWAL(walAdd, objectID, newSim, tags)
+	s.add(Object{ObjectId: objectID, S: newSim, Tags: tags})
+	return nil
+}
+
+// Reindex changes K and rebuilds every bucket from the tracked fingerprints
+func (s *SimhashIndex) Reindex(newK int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if newK < 0 {
+		return fmt.Errorf("k should not be negative, got %d", newK)
+	}
+	if len(s.objects) == 0 && s.bucketCount() > 0 {
+		return errors.New("index has no tracked fingerprints to rebuild from")
+	}
+
+	s.K = newK
+	s.blocks = 0
+	if s.recall > 0 {
+		s.blocks = OptimalBlocksForRecall(s.F, s.K, s.recall)
+	}
+	s.Bucket = map[string]map[string]string{}
+	if s.sorted != nil {
+		s.sorted = map[string][]sortedEntry{}
+	}
+	for id, sim := range s.objects {
+		val := bucketEntry(id, sim)
+		for _, key := range s.keys(sim) {
+			s.putEntry(key, id, val, sim)
+		}
+	}
+	return nil
+}
+
+// Range calls fn for every object stored in the index, once per object id.
+// Iteration stops early if fn returns false. The index is read locked while
+// ranging, so fn must not modify it.
+func (s *SimhashIndex) Range(fn func(objectID string, sim *Simhash) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for id, sim := range s.objects {
+		if !fn(id, bareSimhash(new(big.Int).Set(sim.Value), sim.F)) {
+			return
 		}
 	}
 }
 
+// masked returns sim with the ignored bits cleared, or sim itself when the
+// index ignores no bits
+func (s *SimhashIndex) masked(sim *Simhash) *Simhash {
+	if s.ignoreMask == nil {
+		return sim
+	}
+	return bareSimhash(new(big.Int).AndNot(sim.Value, s.ignoreMask), sim.F)
+}
+
+func (s *SimhashIndex) removeEntry(objectID string, sim *Simhash) bool {
+	val := bucketEntry(objectID, sim)
+	removed := false
+	for _, key := range s.keys(sim) {
+		removed = s.dropEntry(key, objectID, val, sim) || removed
+	}
+	return removed
+}
+
+// bucketEntry encodes an object as its fixed width Hex, so every entry of
+// an index starts with F/4 digits, then a comma and the object id
+func bucketEntry(objectID string, sim *Simhash) string {
+	return sim.Hex() + "," + objectID
+}
+
+// parseEntry splits a bucket entry back into its object id and fingerprint
+func parseEntry(val string, f int) (string, *Simhash, bool) {
+	parts := strings.SplitN(val, ",", 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	hexVal, objID := parts[0], parts[1]
+	hashVal, ok := new(big.Int).SetString(hexVal, 16)
+	if !ok {
+		return "", nil, false
+	}
+
+	return objID, bareSimhash(hashVal, f), true
+}
+
 func (s *SimhashIndex) GetNearDups(simhash *Simhash) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.nearDups(simhash, s.K)
+}
+
+// GetNearDupsK is like GetNearDups but filters candidates with tolerance k
+// instead of the index's K. Candidates are still generated from the index
+// blocks, so duplicates further than GuaranteedRecallDistance may be missed.
+func (s *SimhashIndex) GetNearDupsK(simhash *Simhash, k int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if limit := s.numBlocks() - 1; k > limit {
+		s.Log.Warn("query tolerance exceeds the index recall guarantee, some duplicates may be missed", "k", k, "guaranteed", limit)
+	}
+	return s.nearDups(simhash, k)
+}
+
+// GuaranteedRecallDistance returns the largest Hamming distance for which
+// the index is guaranteed to find every duplicate. With K+1 blocks any two
+// fingerprints within K bits agree on at least one block, so this is K
+// unless the block count was lowered with SimhashIndexWithRecall.
+func (s *SimhashIndex) GuaranteedRecallDistance() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.numBlocks() - 1
+}
+
+// GetNearDupsBatch runs GetNearDups for every query in parallel under a
+// single read lock, returning the results in the order of queries. Bucket
+// entries are parsed once per worker and reused across its queries.
+func (s *SimhashIndex) GetNearDupsBatch(queries []*Simhash) [][]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([][]string, len(queries))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(runtime.NumCPU(), len(queries)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache := make(map[string]parsedEntry)
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(queries) {
+					return
+				}
+				results[i] = s.nearDupsCached(queries[i], s.K, cache)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+type parsedEntry struct {
+	id  string
+	sim *Simhash
+	ok  bool
+}
+
+func (s *SimhashIndex) nearDups(simhash *Simhash, k int) []string {
+	return s.nearDupsCached(simhash, k, nil)
+}
+
+// nearDupsCached is nearDups reusing the parsed bucket entries in cache, if any
+func (s *SimhashIndex) nearDupsCached(simhash *Simhash, k int, cache map[string]parsedEntry) []string {
+	matches := s.matches(simhash, k, cache)
+	if matches == nil {
+		return nil
+	}
+
+	var ans []string
+	for id := range matches {
+		ans = append(ans, id)
+	}
+	return ans
+}
+
+// matches returns the distance of every object within k of simhash, reusing
+// the parsed bucket entries in cache, if any
+func (s *SimhashIndex) matches(simhash *Simhash, k int, cache map[string]parsedEntry) map[string]int {
+	s.queries.Add(1)
 	if simhash.F != s.F {
 		return nil
 	}
+	simhash = s.masked(simhash)
+
+	result := make(map[string]int)
+	var seen map[string]*Simhash
+	var conflicts map[string]struct{}
+	if s.strict {
+		seen = make(map[string]*Simhash)
+		conflicts = make(map[string]struct{})
+	}
+	record := func(id string, sim *Simhash, d int) {
+		if seen != nil {
+			if prev, ok := seen[id]; !ok {
+				seen[id] = sim
+			} else if !prev.Equal(sim) {
+				conflicts[id] = struct{}{}
+			}
+		}
+		if prev, ok := result[id]; !ok || d < prev {
+			result[id] = d
+		}
+	}
 
-	result := make(map[string]struct{})
-	for _, key := range s.GetKeys(simhash) {
+	for _, key := range s.keys(simhash) {
+		if s.sorted != nil {
+			s.sortedMatches(s.sorted[key], simhash, k, record)
+			continue
+		}
 		for val := range s.Bucket[key] {
-			parts := strings.SplitN(val, ",", 2)
-			if len(parts) != 2 {
+			entry, cached := cache[val]
+			if !cached {
+				entry.id, entry.sim, entry.ok = parseEntry(val, s.F)
+				if cache != nil {
+					cache[val] = entry
+				}
+			}
+			if !entry.ok {
 				continue
 			}
-			hexVal, objID := parts[0], parts[1]
-			hashVal := new(big.Int)
-			hashVal.SetString(hexVal, 16)
-
-			dup := &Simhash{Value: hashVal, F: s.F}
-			if simhash.Distance(dup) <= s.K {
-				result[objID] = struct{}{}
+			if d := simhash.Distance(entry.sim); d <= k {
+				record(entry.id, entry.sim, d)
 			}
 		}
 	}
 
+	if len(conflicts) > 0 {
+		s.Log.Warn("object ids matched with more than one fingerprint, the index is inconsistent", "ids", slices.Sorted(maps.Keys(conflicts)))
+	}
+	return result
+}
+
+// sortedMatches only checks the entries whose popcount is within k of the query's
+func (s *SimhashIndex) sortedMatches(entries []sortedEntry, simhash *Simhash, k int, record func(id string, sim *Simhash, d int)) {
+	pop := simhash.popCount()
+	start, _ := slices.BinarySearchFunc(entries, pop-k, func(e sortedEntry, target int) int {
+		return e.pop - target
+	})
+	for _, e := range entries[start:] {
+		if e.pop > pop+k {
+			break
+		}
+		if d := simhash.Distance(e.sim); d <= k {
+			record(e.id, e.sim, d)
+		}
+	}
+}
+
+// GetNearDupsFiltered returns the objects within K of simhash whose tags
+// contain every key and value of match. Tags are kept per object id next to
+// its tracked fingerprint rather than in every bucket entry, and are carried
+// by SaveCompact, ExportJSONL, MarshalObjects and the write-ahead log.
+func (s *SimhashIndex) GetNearDupsFiltered(simhash *Simhash, match map[string]string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	var ans []string
-	for id := range result {
-		ans = append(ans, id)
+	for id := range s.matches(simhash, s.K, nil) {
+		if tagsMatch(s.tags[id], match) {
+			ans = append(ans, id)
+		}
 	}
 	return ans
 }
 
+func tagsMatch(tags, match map[string]string) bool {
+	for key, want := range match {
+		if got, ok := tags[key]; !ok || got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// GetNearDupsWithDistance returns the objects within K of simhash mapped to
+// their Hamming distance from it
+func (s *SimhashIndex) GetNearDupsWithDistance(simhash *Simhash) map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.matches(simhash, s.K, nil)
+}
+
+// GetDups returns, from a single bucket walk, the ids of the objects exactly
+// matching sim, sorted, and of those within K but not exact, sorted by
+// distance then id
+func (s *SimhashIndex) GetDups(sim *Simhash) (exact []string, near []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matches := s.matches(sim, s.K, nil)
+	for id, d := range matches {
+		if d == 0 {
+			exact = append(exact, id)
+		} else {
+			near = append(near, id)
+		}
+	}
+	slices.Sort(exact)
+	slices.SortFunc(near, func(a, b string) int {
+		if c := cmp.Compare(matches[a], matches[b]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return exact, near
+}
+
+// GetNearDupsGrouped returns the objects within K of simhash grouped by their
+// exact distance, each group sorted by object id
+func (s *SimhashIndex) GetNearDupsGrouped(simhash *Simhash) map[int][]string {
+	matches := s.GetNearDupsWithDistance(simhash)
+	if matches == nil {
+		return nil
+	}
+
+	groups := make(map[int][]string)
+	for id, d := range matches {
+		groups[d] = append(groups[d], id)
+	}
+	for _, ids := range groups {
+		slices.Sort(ids)
+	}
+	return groups
+}
+
 // from python implementation
 //
 // """
 // You may optimize this method according to <http://static.googleusercontent.com/media/research.google.com/en//pubs/archive/33026.pdf>
 // """
 func (s *SimhashIndex) GetKeys(sim *Simhash) []string {
-	offsets := s.Offsets()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys(sim)
+}
+
+func (s *SimhashIndex) keys(sim *Simhash) []string {
+	return blockKeys(s.masked(sim), s.F, s.numBlocks()-1)
+}
+
+func (s *SimhashIndex) Offsets() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return blockOffsets(s.F, s.numBlocks()-1)
+}
+
+// BlockDistances returns the number of differing bits between a and b within
+// each index block, in the order of Offsets. Two fingerprints are candidates
+// for each other only if one of the blocks is zero, which every pair within
+// GuaranteedRecallDistance satisfies, so this explains why a pair was missed.
+func (s *SimhashIndex) BlockDistances(a, b *Simhash) []int {
+	if a.F != s.F || b.F != s.F {
+		panic("simhashes must have same dimensions")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.blockDistances(a, b)
+}
+
+func (s *SimhashIndex) blockDistances(a, b *Simhash) []int {
+	offsets := blockOffsets(s.F, s.numBlocks()-1)
+
+	xor := new(big.Int).Xor(s.masked(a).Value, s.masked(b).Value)
+	distances := make([]int, len(offsets))
+	for i, offset := range offsets {
+		end := s.F
+		if i < len(offsets)-1 {
+			end = offsets[i+1]
+		}
+		for bit := offset; bit < end; bit++ {
+			distances[i] += int(xor.Bit(bit))
+		}
+	}
+	return distances
+}
+
+// BlockStats summarizes how the index blocks of known duplicate pairs
+// collide, see BlockCollisionStats
+type BlockStats struct {
+	// Pairs is the number of pairs measured and Missing the number skipped
+	// because an id isn't in the index
+	Pairs   int
+	Missing int
+	// BlockMatches counts, for each block in the order of Offsets, the pairs
+	// identical on that block
+	BlockMatches []int
+	// MatchingBlocks counts the pairs by how many of their blocks are
+	// identical, a pair counted at 0 is never returned by a query
+	MatchingBlocks []int
+}
+
+// BlockCollisionStats measures, over pairs of ids of objects known to be
+// duplicates, how often each block of the index matches exactly. A block
+// that rarely matches for true duplicates does little for recall, and many
+// pairs without any matching block mean F or K should change.
+func (s *SimhashIndex) BlockCollisionStats(pairs [][2]string) BlockStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blocks := s.numBlocks()
+	stats := BlockStats{
+		BlockMatches:   make([]int, blocks),
+		MatchingBlocks: make([]int, blocks+1),
+	}
+	for _, pair := range pairs {
+		a, okA := s.objects[pair[0]]
+		b, okB := s.objects[pair[1]]
+		if !okA || !okB {
+			stats.Missing++
+			continue
+		}
+		stats.Pairs++
+		matching := 0
+		for i, d := range s.blockDistances(a, b) {
+			if d == 0 {
+				stats.BlockMatches[i]++
+				matching++
+			}
+		}
+		stats.MatchingBlocks[matching]++
+	}
+	return stats
+}
+
+// Validate checks the index is internally consistent: every bucket entry
+// parses and sits in a bucket its fingerprint maps to, every entry appears in
+// exactly K+1 buckets, no bucket is empty and the tracked objects match the
+// bucket entries. It returns an error describing the first problem found.
+func (s *SimhashIndex) Validate() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int)
+	buckets := s.buckets()
+	for _, key := range slices.Sorted(maps.Keys(buckets)) {
+		entries := buckets[key]
+		if len(entries) == 0 {
+			return fmt.Errorf("bucket %q is empty", key)
+		}
+		if s.sorted != nil && !slices.IsSortedFunc(s.sorted[key], compareSortedEntries) {
+			return fmt.Errorf("bucket %q is not sorted", key)
+		}
+		for _, val := range slices.Sorted(maps.Keys(entries)) {
+			id, sim, ok := parseEntry(val, s.F)
+			if !ok {
+				return fmt.Errorf("bucket %q has malformed entry %q", key, val)
+			}
+			if !slices.Contains(s.keys(sim), key) {
+				return fmt.Errorf("entry %q is in bucket %q which its fingerprint does not map to", val, key)
+			}
+			if tracked, ok := s.objects[id]; !ok || !tracked.Equal(sim) {
+				return fmt.Errorf("entry %q does not match the fingerprint tracked for object %q", val, id)
+			}
+			counts[val]++
+		}
+	}
+
+	for _, val := range slices.Sorted(maps.Keys(counts)) {
+		if n := counts[val]; n != s.numBlocks() {
+			return fmt.Errorf("entry %q appears in %d buckets, expected %d", val, n, s.numBlocks())
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(s.objects)) {
+		if _, ok := counts[bucketEntry(id, s.objects[id])]; !ok {
+			return fmt.Errorf("object %q is tracked but not in any bucket", id)
+		}
+		if !slices.Contains(s.exact[s.objects[id].Hex()], id) {
+			return fmt.Errorf("object %q is missing from the exact fingerprint map", id)
+		}
+	}
+	exact := 0
+	for _, ids := range s.exact {
+		exact += len(ids)
+	}
+	if exact != len(s.objects) {
+		return fmt.Errorf("exact fingerprint map holds %d ids, expected %d", exact, len(s.objects))
+	}
+
+	return nil
+}
+
+// CandidateCount returns the number of bucket entries a query for sim would
+// check, without parsing them or computing any distance. An entry sharing
+// several blocks with sim is counted once per block, so this is an upper
+// bound on the distinct candidates, but such entries are usually near
+// duplicates and few. It is meant to decide whether a query is worth running.
+func (s *SimhashIndex) CandidateCount(sim *Simhash) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if sim.F != s.F {
+		return 0
+	}
+	count := 0
+	for _, key := range s.keys(sim) {
+		count += s.bucketLen(key)
+	}
+	return count
+}
+
+func (s *SimhashIndex) BucketSize() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bucketCount()
+}
+
+// BlockKeys returns the bucket keys sim maps to when its F bits are split
+// into k+1 blocks, the same keys GetKeys returns from an index with the F of
+// sim and K k, so fingerprints can be routed by key without an index
+func BlockKeys(sim *Simhash, k int) []string {
+	return blockKeys(sim, sim.F, k)
+}
+
+// Equal reports whether other has the same F, K and blocks and holds the same
+// entries in the same buckets, whatever order they were added in. Other
+// settings, such as the WAL or counters, aren't compared. The buckets of s
+// are copied under its lock, which is released before other is locked, so
+// the two indexes are never locked together.
+func (s *SimhashIndex) Equal(other *SimhashIndex) bool {
+	if s == other {
+		return true
+	}
+	s.mu.RLock()
+	f, k, blocks := s.F, s.K, s.numBlocks()
+	buckets := make(map[string]map[string]string, s.bucketCount())
+	for key, entries := range s.buckets() {
+		buckets[key] = maps.Clone(entries)
+	}
+	s.mu.RUnlock()
+
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+
+	otherBuckets := other.buckets()
+	if f != other.F || k != other.K || blocks != other.numBlocks() || len(buckets) != len(otherBuckets) {
+		return false
+	}
+	for key, entries := range buckets {
+		otherEntries, ok := otherBuckets[key]
+		if !ok || !maps.Equal(entries, otherEntries) {
+			return false
+		}
+	}
+	return true
+}
+
+// blockKeys returns the bucket keys of sim when its f bits are split into
+// k+1 blocks, one key per block
+func blockKeys(sim *Simhash, f, k int) []string {
+	offsets := blockOffsets(f, k)
 	keys := make([]string, 0, len(offsets))
 
 	for i, offset := range offsets {
 		var maskLen int
 		if i == len(offsets)-1 {
-			maskLen = s.F - offset
+			maskLen = f - offset
 		} else {
 			maskLen = offsets[i+1] - offset
 		}
@@ -433,15 +3199,11 @@ func (s *SimhashIndex) GetKeys(sim *Simhash) []string {
 	return keys
 }
 
-func (s *SimhashIndex) Offsets() []int {
-	offsets := make([]int, s.K+1)
-	chunk := s.F / (s.K + 1)
-	for i := 0; i <= s.K; i++ {
+func blockOffsets(f, k int) []int {
+	offsets := make([]int, k+1)
+	chunk := f / (k + 1)
+	for i := 0; i <= k; i++ {
 		offsets[i] = chunk * i
 	}
 	return offsets
 }
-
-func (s *SimhashIndex) BucketSize() int {
-	return len(s.Bucket)
-}
@@ -0,0 +1,116 @@
+package simhash
+
+import (
+	"math"
+	"math/big"
+)
+
+// OptimalBlocks returns the number of blocks an f bit fingerprint must be
+// split into so that two fingerprints at most maxDist bits apart always share
+// an identical block. By the pigeonhole principle maxDist differing bits can
+// touch at most maxDist blocks, so maxDist+1 blocks are needed. It is capped
+// at f, the point where every block is a single bit.
+func OptimalBlocks(f, maxDist int) int {
+	return max(min(maxDist+1, f), 1)
+}
+
+// SuggestFForDistance returns the smallest F, at least the default 64, that
+// is a whole number of bytes and splits evenly into the maxDist+1 blocks an
+// index needs to find every fingerprint within maxDist. Otherwise the
+// remainder bits all go to the last block, making the blocks uneven, which
+// NewSimhashIndex warns about for non-default layouts.
+func SuggestFForDistance(maxDist int) int {
+	blocks := max(maxDist+1, 1)
+	return evenF(max(defaultF, blocks), blocks)
+}
+
+// evenF returns the smallest F of at least minF that is a whole number of
+// bytes and splits evenly into the given number of blocks
+func evenF(minF, blocks int) int {
+	step := 8 * blocks / gcd(8, blocks)
+	return (minF + step - 1) / step * step
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// OptimalBlocksForRecall returns the smallest number of blocks for which two
+// fingerprints exactly maxDist bits apart share an identical block with at
+// least the given probability, see BlockRecall. With blocks acting as
+// separate lookup tables, fewer blocks trade recall for smaller candidate
+// sets. A recall of 1 or more gives OptimalBlocks(f, maxDist).
+func OptimalBlocksForRecall(f, maxDist int, recall float64) int {
+	limit := OptimalBlocks(f, maxDist)
+	for blocks := 1; blocks < limit; blocks++ {
+		if BlockRecall(f, blocks, maxDist) >= recall {
+			return blocks
+		}
+	}
+	return limit
+}
+
+// BlockRecall returns the probability that two f bit fingerprints differing in
+// dist uniformly random bits agree on at least one of the given number of
+// blocks, laid out like SimhashIndex.Offsets. It is computed exactly by
+// inclusion-exclusion over the blocks that stay clean.
+func BlockRecall(f, blocks, dist int) float64 {
+	if dist <= 0 {
+		return 1
+	}
+	if blocks <= 0 || dist > f {
+		return 0
+	}
+
+	chunk := f / blocks
+	last := f - chunk*(blocks-1)
+
+	// clean(n) counts the ways of placing dist differing bits in n positions
+	clean := func(n int) *big.Int {
+		if n < dist {
+			return new(big.Int)
+		}
+		return new(big.Int).Binomial(int64(n), int64(dist))
+	}
+
+	matched := new(big.Int)
+	for j := 1; j <= blocks; j++ {
+		// j clean blocks, either all regular ones or including the last one
+		term := new(big.Int).Mul(new(big.Int).Binomial(int64(blocks-1), int64(j)), clean(f-j*chunk))
+		term.Add(term, new(big.Int).Mul(new(big.Int).Binomial(int64(blocks-1), int64(j-1)), clean(f-(j-1)*chunk-last)))
+		if j%2 == 1 {
+			matched.Add(matched, term)
+		} else {
+			matched.Sub(matched, term)
+		}
+	}
+
+	p, _ := new(big.Rat).SetFrac(matched, clean(f)).Float64()
+	return p
+}
+
+// EstimateFalsePositiveRate returns the probability that a query unrelated to
+// a corpus of corpusSize random fingerprints gets at least one of them back
+// as a near duplicate. Such a pair is a match when its d differing bits leave
+// a block identical, with probability BlockRecall, and d is at most K, so
+// one pair matches with probability sum over d <= K of C(F, d) / 2^F times
+// BlockRecall, and the corpus with 1 - (1 - p)^corpusSize.
+func (s *SimhashIndex) EstimateFalsePositiveRate(corpusSize int) float64 {
+	s.mu.RLock()
+	f, k, blocks := s.F, s.K, s.numBlocks()
+	s.mu.RUnlock()
+
+	if corpusSize <= 0 {
+		return 0
+	}
+	p := 0.0
+	for d := 0; d <= min(k, f); d++ {
+		pairs := new(big.Float).SetInt(new(big.Int).Binomial(int64(f), int64(d)))
+		within, _ := pairs.SetMantExp(pairs, -f).Float64()
+		p += within * BlockRecall(f, blocks, d)
+	}
+	return -math.Expm1(float64(corpusSize) * math.Log1p(-p))
+}
@@ -0,0 +1,146 @@
+package simhash_test
+
+import (
+	"bytes"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestBlocks(t *testing.T) {
+	t.Run("test optimal blocks", func(t *testing.T) {
+		if b := s.OptimalBlocks(64, 3); b != 4 {
+			t.Errorf("Expected 4 blocks, got %d", b)
+		}
+		if b := s.OptimalBlocks(8, 20); b != 8 {
+			t.Errorf("Expected blocks capped at f, got %d", b)
+		}
+	})
+
+	t.Run("test block keys", func(t *testing.T) {
+		sim := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg", s.WithF(128))
+		index := s.NewSimhashIndex(nil, s.SimhashIndexWithF(128), s.SimhashIndexWithK(5))
+		keys := s.BlockKeys(sim, 5)
+		if len(keys) != 6 {
+			t.Fatalf("Expected 6 keys, got %d", len(keys))
+		}
+		if !slices.Equal(keys, index.GetKeys(sim)) {
+			t.Errorf("Expected the index keys %v, got %v", index.GetKeys(sim), keys)
+		}
+	})
+
+	t.Run("test estimate false positive rate", func(t *testing.T) {
+		index := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3))
+		// 1 + 64 + 2016 + 41664 fingerprints lie within 3 bits
+		pair := 43745 / math.Exp2(64)
+		if r := index.EstimateFalsePositiveRate(1); math.Abs(r-pair) > pair*1e-9 {
+			t.Errorf("Expected %g for a single object, got %g", pair, r)
+		}
+		if r := index.EstimateFalsePositiveRate(1_000_000); math.Abs(r-pair*1e6) > pair*1e6*1e-6 {
+			t.Errorf("Expected about %g for a million objects, got %g", pair*1e6, r)
+		}
+		if r := index.EstimateFalsePositiveRate(0); r != 0 {
+			t.Errorf("Expected 0 for an empty corpus, got %g", r)
+		}
+
+		// two blocks miss some pairs within K, matching fewer unrelated ones
+		fewer := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3), s.SimhashIndexWithRecall(0.5))
+		if a, b := fewer.EstimateFalsePositiveRate(1000), index.EstimateFalsePositiveRate(1000); a >= b {
+			t.Errorf("Expected fewer blocks to lower the rate, got %g against %g", a, b)
+		}
+
+		wide := s.NewSimhashIndex(nil, s.SimhashIndexWithK(40))
+		if r := wide.EstimateFalsePositiveRate(100); r < 0.99 {
+			t.Errorf("Expected a k of 40 to match nearly everything, got %g", r)
+		}
+	})
+
+	t.Run("test block recall", func(t *testing.T) {
+		if r := s.BlockRecall(64, 3, 2); r != 1 {
+			t.Errorf("Expected full recall with K+1 blocks, got %f", r)
+		}
+		if r := s.BlockRecall(64, 1, 1); r != 0 {
+			t.Errorf("Expected no recall with a single block, got %f", r)
+		}
+		// both differing bits must land in the same half
+		if r, want := s.BlockRecall(64, 2, 2), 2*496.0/2016; math.Abs(r-want) > 1e-12 {
+			t.Errorf("Expected %f, got %f", want, r)
+		}
+		if r := s.BlockRecall(63, 4, 3); r != 1 {
+			t.Errorf("Expected full recall with uneven blocks, got %f", r)
+		}
+	})
+
+	t.Run("test optimal blocks for recall", func(t *testing.T) {
+		if b := s.OptimalBlocksForRecall(64, 3, 1); b != 4 {
+			t.Errorf("Expected 4 blocks for full recall, got %d", b)
+		}
+		b := s.OptimalBlocksForRecall(64, 3, 0.5)
+		if b >= 4 || s.BlockRecall(64, b, 3) < 0.5 || s.BlockRecall(64, b-1, 3) >= 0.5 {
+			t.Errorf("Expected the fewest blocks reaching 0.5 recall, got %d", b)
+		}
+	})
+
+	t.Run("test index with recall", func(t *testing.T) {
+		var objs []s.Object
+		for i := range 50 {
+			objs = append(objs, s.Object{ObjectId: strconv.Itoa(i), S: s.NewSimhash("document number " + strconv.Itoa(i))})
+		}
+
+		index := s.NewSimhashIndex(objs, s.SimhashIndexWithK(3), s.SimhashIndexWithRecall(0.5))
+		blocks := s.OptimalBlocksForRecall(64, 3, 0.5)
+		if got := len(index.Offsets()); got != blocks {
+			t.Errorf("Expected %d blocks, got %d", blocks, got)
+		}
+		if got := index.GuaranteedRecallDistance(); got != blocks-1 {
+			t.Errorf("Expected guaranteed distance %d, got %d", blocks-1, got)
+		}
+		if err := index.Validate(); err != nil {
+			t.Errorf("Expected a valid index, got %v", err)
+		}
+
+		for _, obj := range objs {
+			found := false
+			for _, id := range index.GetNearDups(obj.S) {
+				found = found || id == obj.ObjectId
+			}
+			if !found {
+				t.Errorf("Expected to find %s", obj.ObjectId)
+			}
+		}
+	})
+
+	t.Run("test suggest f for distance", func(t *testing.T) {
+		cases := map[int]int{0: 64, 1: 64, 2: 72, 3: 64, 4: 80, 7: 64, 10: 88, 15: 64, 63: 64, 99: 200}
+		for maxDist, expected := range cases {
+			f := s.SuggestFForDistance(maxDist)
+			if f != expected {
+				t.Errorf("Expected %d for distance %d, got %d", expected, maxDist, f)
+			}
+			if f%8 != 0 || f%(maxDist+1) != 0 {
+				t.Errorf("Expected %d to be byte aligned and split into %d blocks", f, maxDist+1)
+			}
+		}
+
+		var logs bytes.Buffer
+		log := slog.New(slog.NewTextHandler(&logs, nil))
+		s.NewSimhashIndex(nil, s.SimhashIndexWithK(3), s.SimhashIndexWithLog(log))
+		if logs.Len() != 0 {
+			t.Errorf("Did not expect a warning for 4 blocks of 16 bits, got %q", logs.String())
+		}
+		s.NewSimhashIndex(nil, s.SimhashIndexWithK(4), s.SimhashIndexWithLog(log))
+		if !strings.Contains(logs.String(), "suggested=80") {
+			t.Errorf("Expected a warning suggesting f 80, got %q", logs.String())
+		}
+		logs.Reset()
+		s.NewSimhashIndex(nil, s.SimhashIndexWithF(128), s.SimhashIndexWithK(2), s.SimhashIndexWithLog(log))
+		if !strings.Contains(logs.String(), "suggested=144") {
+			t.Errorf("Expected a warning suggesting f 144 rather than a smaller f, got %q", logs.String())
+		}
+	})
+}
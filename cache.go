@@ -0,0 +1,72 @@
+package simhash
+
+import (
+	"container/list"
+	"sync"
+)
+
+// HashCache stores HashFunc outputs by token. Implementations must be safe
+// for concurrent use and must not modify the hashes they are given.
+type HashCache interface {
+	Get(token string) ([]byte, bool)
+	Put(token string, hash []byte)
+}
+
+// LRUHashCache is a HashCache keeping at most a fixed number of tokens,
+// evicting the least recently used one first
+type LRUHashCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	token string
+	hash  []byte
+}
+
+// NewLRUHashCache returns an LRUHashCache holding up to size tokens
+func NewLRUHashCache(size int) *LRUHashCache {
+	return &LRUHashCache{
+		size:  max(size, 1),
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *LRUHashCache) Get(token string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[token]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruItem).hash, true
+}
+
+func (c *LRUHashCache) Put(token string, hash []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[token]; ok {
+		el.Value.(*lruItem).hash = hash
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[token] = c.order.PushFront(&lruItem{token: token, hash: hash})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruItem).token)
+	}
+}
+
+// Len returns the number of cached tokens
+func (c *LRUHashCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
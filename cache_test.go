@@ -0,0 +1,51 @@
+package simhash_test
+
+import (
+	"crypto/md5"
+	"testing"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestHashCache(t *testing.T) {
+	t.Run("test cached build", func(t *testing.T) {
+		calls := 0
+		countingHash := func(x []byte) []byte {
+			calls++
+			hash := md5.Sum(x)
+			return hash[:]
+		}
+
+		cache := s.NewLRUHashCache(1000)
+		text := "How are you? I AM fine. Thank And you?"
+
+		first := s.NewSimhash(text, s.WithHashFunc(countingHash), s.WithHashCache(cache))
+		firstCalls := calls
+		second := s.NewSimhash(text, s.WithHashFunc(countingHash), s.WithHashCache(cache))
+
+		if !first.Equal(s.NewSimhash(text)) || !second.Equal(first) {
+			t.Error("Caching hashes should not change the fingerprint")
+		}
+		if firstCalls == 0 || calls != firstCalls+1 {
+			t.Errorf("Expected only the construction probe to hash on the second build, got %d then %d calls", firstCalls, calls)
+		}
+	})
+
+	t.Run("test lru eviction", func(t *testing.T) {
+		cache := s.NewLRUHashCache(2)
+		cache.Put("a", []byte{1})
+		cache.Put("b", []byte{2})
+		cache.Get("a")
+		cache.Put("c", []byte{3})
+
+		if _, ok := cache.Get("b"); ok {
+			t.Error("Expected b to be evicted as least recently used")
+		}
+		if h, ok := cache.Get("a"); !ok || h[0] != 1 {
+			t.Error("Expected a to stay cached")
+		}
+		if cache.Len() != 2 {
+			t.Errorf("Expected 2 cached tokens, got %d", cache.Len())
+		}
+	})
+}
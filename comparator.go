@@ -0,0 +1,95 @@
+package simhash
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"math/bits"
+)
+
+// Comparator measures distances from one query fingerprint, keeping the
+// query as uint64 words so scanning many candidates doesn't convert it again
+// for every comparison
+type Comparator struct {
+	query *Simhash
+	words []uint64
+	// last masks the final word down to the bits within F
+	last uint64
+}
+
+// NewDistanceComparator returns a Comparator for query
+func NewDistanceComparator(query *Simhash) *Comparator {
+	last := uint64(math.MaxUint64)
+	if rem := query.F % 64; rem != 0 {
+		last = 1<<rem - 1
+	}
+	return &Comparator{query: query, words: query.Words(), last: last}
+}
+
+// Distance returns the same value as the query's Distance to candidate,
+// panicking likewise when their dimensions differ
+func (c *Comparator) Distance(candidate *Simhash) int {
+	if candidate.F != c.query.F {
+		panic("simhashes must have same dimensions")
+	}
+	if c.query.isShort && candidate.isShort {
+		return c.query.shortTextDistance(candidate)
+	}
+
+	cw := candidate.Value.Bits()
+	count := 0
+	for i, w := range c.words {
+		x := w ^ word64(cw, i)
+		if i == len(c.words)-1 {
+			x &= c.last
+		}
+		count += bits.OnesCount64(x)
+	}
+	return count
+}
+
+// word64 returns the i-th little-endian 64 bit word of a big.Int's bits,
+// whatever the platform word size
+func word64(words []big.Word, i int) uint64 {
+	if bits.UintSize == 64 {
+		return uint64(wordAt(words, i))
+	}
+	return uint64(wordAt(words, 2*i)) | uint64(wordAt(words, 2*i+1))<<32
+}
+
+// Distances returns the Distance from s to each of others, in order. It
+// checks up front that all of them share the F of s, panicking otherwise,
+// and extracts the words of s once for the whole slice.
+func (s *Simhash) Distances(others []*Simhash) []int {
+	for _, other := range others {
+		if other.F != s.F {
+			panic("simhashes must have same dimensions")
+		}
+	}
+
+	c := NewDistanceComparator(s)
+	distances := make([]int, len(others))
+	for i, other := range others {
+		distances[i] = c.Distance(other)
+	}
+	return distances
+}
+
+// DistanceBytes returns the number of differing bits between two big-endian
+// fingerprints, such as from Bytes, a word at a time and without allocating,
+// so fingerprints kept as byte arrays can be scanned directly. It panics when
+// their lengths differ.
+func DistanceBytes(a, b []byte) int {
+	if len(a) != len(b) {
+		panic("simhashes must have same dimensions")
+	}
+	count := 0
+	for len(a) >= 8 {
+		count += bits.OnesCount64(binary.BigEndian.Uint64(a) ^ binary.BigEndian.Uint64(b))
+		a, b = a[8:], b[8:]
+	}
+	for i := range a {
+		count += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return count
+}
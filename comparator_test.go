@@ -0,0 +1,98 @@
+package simhash_test
+
+import (
+	"math/big"
+	"math/rand/v2"
+	"testing"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestComparator(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	random := func(f int) *s.Simhash {
+		words := make([]uint64, (f+63)/64)
+		for i := range words {
+			words[i] = rng.Uint64()
+		}
+		return s.NewSimhashFromWords(words, f)
+	}
+
+	t.Run("test matches distance", func(t *testing.T) {
+		for _, f := range []int{8, 64, 72, 128, 200} {
+			query := random(f)
+			c := s.NewDistanceComparator(query)
+			for range 100 {
+				candidate := random(f)
+				if got, expected := c.Distance(candidate), query.Distance(candidate); got != expected {
+					t.Fatalf("Expected %d at f %d, got %d", expected, f, got)
+				}
+			}
+		}
+	})
+
+	t.Run("test distances", func(t *testing.T) {
+		query := random(128)
+		others := []*s.Simhash{random(128), query, random(128)}
+		distances := query.Distances(others)
+		for i, other := range others {
+			if distances[i] != query.Distance(other) {
+				t.Errorf("Expected %d at %d, got %d", query.Distance(other), i, distances[i])
+			}
+		}
+		if len(query.Distances(nil)) != 0 {
+			t.Error("Expected no distances for no others")
+		}
+
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a panic for mismatched dimensions")
+			}
+		}()
+		query.Distances([]*s.Simhash{random(128), random(64)})
+	})
+
+	t.Run("test distance bytes", func(t *testing.T) {
+		for _, f := range []int{8, 64, 72, 128, 200} {
+			a, b := random(f), random(f)
+			if got, expected := s.DistanceBytes(a.Bytes(), b.Bytes()), a.Distance(b); got != expected {
+				t.Errorf("Expected %d at f %d, got %d", expected, f, got)
+			}
+		}
+		var x, y [8]byte
+		y[0] = 0x81
+		if d := s.DistanceBytes(x[:], y[:]); d != 2 {
+			t.Errorf("Expected 2, got %d", d)
+		}
+
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a panic for mismatched lengths")
+			}
+		}()
+		s.DistanceBytes(x[:], y[:4])
+	})
+
+	t.Run("test bits beyond f are ignored", func(t *testing.T) {
+		c := s.NewDistanceComparator(s.NewSimhash(big.NewInt(0), s.WithF(8)))
+		if d := c.Distance(s.NewSimhash(big.NewInt(0x1ff), s.WithF(8))); d != 8 {
+			t.Errorf("Expected 8, got %d", d)
+		}
+	})
+}
+
+func BenchmarkComparator(b *testing.B) {
+	query := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg")
+	candidate := s.NewSimhash("This is simhash test.")
+	b.Run("distance", func(b *testing.B) {
+		for b.Loop() {
+			query.Distance(candidate)
+		}
+	})
+	b.Run("comparator", func(b *testing.B) {
+		c := s.NewDistanceComparator(query)
+		for b.Loop() {
+			c.Distance(candidate)
+		}
+	})
+}
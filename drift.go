@@ -0,0 +1,98 @@
+package simhash
+
+import (
+	"math/big"
+	"sync"
+)
+
+// DriftMonitor tracks how far each new document is from the recent ones. It
+// keeps the bitwise majority fingerprint, the centroid, of the last Window
+// documents pushed, and measures every new document against the centroid of
+// the documents before it.
+type DriftMonitor struct {
+	Window int
+	F      int
+
+	mu     sync.Mutex
+	ring   []*Simhash
+	next   int
+	counts []int
+	last   int
+}
+
+// NewDriftMonitor returns a DriftMonitor over the last window fingerprints of
+// dimension f
+func NewDriftMonitor(window, f int) *DriftMonitor {
+	if window < 1 {
+		defaultLogger.Error("window should be at least 1\ngot", "window:", window)
+		window = 1
+	}
+	return &DriftMonitor{
+		Window: window,
+		F:      f,
+		ring:   make([]*Simhash, 0, window),
+		counts: make([]int, f),
+	}
+}
+
+// Push measures sim against the centroid of the window, then adds it to the
+// window, dropping the oldest document once the window is full. It returns
+// the distance, also available from Distance, which is 0 for the first
+// document.
+func (m *DriftMonitor) Push(sim *Simhash) int {
+	if sim.F != m.F {
+		panic("simhashes must have same dimensions")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.last = 0
+	if len(m.ring) > 0 {
+		m.last = sim.Distance(m.centroid())
+	}
+
+	if len(m.ring) < m.Window {
+		m.ring = append(m.ring, sim)
+	} else {
+		m.count(m.ring[m.next], -1)
+		m.ring[m.next] = sim
+		m.next = (m.next + 1) % m.Window
+	}
+	m.count(sim, 1)
+	return m.last
+}
+
+// Distance returns the distance of the newest document from the centroid of
+// the window before it was pushed
+func (m *DriftMonitor) Distance() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// Centroid returns the bitwise majority of the documents in the window, a
+// bit being set when more than half of them have it set
+func (m *DriftMonitor) Centroid() *Simhash {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.centroid()
+}
+
+func (m *DriftMonitor) centroid() *Simhash {
+	value := new(big.Int)
+	for i, c := range m.counts {
+		if c > len(m.ring)/2 {
+			value.SetBit(value, i, 1)
+		}
+	}
+	return bareSimhash(value, m.F)
+}
+
+// count adds delta to the counts of the bits set in sim
+func (m *DriftMonitor) count(sim *Simhash, delta int) {
+	for i := range m.counts {
+		if sim.Value.Bit(i) == 1 {
+			m.counts[i] += delta
+		}
+	}
+}
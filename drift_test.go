@@ -0,0 +1,56 @@
+package simhash_test
+
+import (
+	"math/big"
+	"testing"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestDriftMonitor(t *testing.T) {
+	fp := func(v uint64) *s.Simhash {
+		return s.NewSimhash(new(big.Int).SetUint64(v))
+	}
+
+	t.Run("test centroid and distance", func(t *testing.T) {
+		m := s.NewDriftMonitor(3, 64)
+		if d := m.Push(fp(0b0111)); d != 0 {
+			t.Errorf("Expected 0 for the first document, got %d", d)
+		}
+		m.Push(fp(0b0011))
+		m.Push(fp(0b0110))
+		if c := m.Centroid().Value.Uint64(); c != 0b0111 {
+			t.Errorf("Expected centroid 0111, got %b", c)
+		}
+
+		if d := m.Push(fp(0b1111_0000)); d != 7 || m.Distance() != 7 {
+			t.Errorf("Expected 7 from the centroid, got %d", d)
+		}
+		// 0111 dropped out of the window
+		if c := m.Centroid().Value.Uint64(); c != 0b0010 {
+			t.Errorf("Expected centroid 0010, got %b", c)
+		}
+	})
+
+	t.Run("test drift is detected", func(t *testing.T) {
+		m := s.NewDriftMonitor(5, 64)
+		for range 10 {
+			if d := m.Push(s.NewSimhash("the weekly report on sales in the northern region")); d != 0 {
+				t.Errorf("Expected no drift for repeated documents, got %d", d)
+			}
+		}
+		if d := m.Push(s.NewSimhash("a completely unrelated text about mountain hiking")); d < 10 {
+			t.Errorf("Expected a large distance for an unrelated document, got %d", d)
+		}
+
+	})
+
+	t.Run("test centroid has a logger", func(t *testing.T) {
+		m := s.NewDriftMonitor(2, 128)
+		m.Push(s.NewSimhash("the weekly report on sales", s.WithF(128)))
+		// truncating the wider centroid logs a warning through its logger
+		if _, err := s.CompareAcrossF(m.Centroid(), s.NewSimhash("the weekly report on sales")); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,399 @@
+package simhash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// maxLineSize bounds a single line read by the line based builders
+const maxLineSize = 16 * 1024 * 1024
+
+// maxStreamF bounds the F read from a binary stream, far above any hash the
+// package ships, so a corrupt F can't make a reader allocate more than 8KiB
+// per fingerprint
+const maxStreamF = 1 << 16
+
+// BuildIndexFromReader builds an index from newline delimited documents,
+// fingerprinting one line at a time. idFn receives the 1-based line number
+// and the line and returns the object id to store it under.
+func BuildIndexFromReader(r io.Reader, idFn func(lineNo int, line string) string, k, f int, options ...Option) (*SimhashIndex, error) {
+	if f%8 != 0 || f <= 0 {
+		return nil, fmt.Errorf("f should be a multiple of 8 and not zero, got %d", f)
+	}
+	index := NewSimhashIndex(nil, SimhashIndexWithK(k), SimhashIndexWithF(f))
+	options = append(options[:len(options):len(options)], WithF(f))
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		sim, err := NewSimhashErr(line, options...)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		index.Add(Object{ObjectId: idFn(lineNo, line), S: sim})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineNo+1, err)
+	}
+
+	return index, nil
+}
+
+// NewSimhashIndexFromHex builds an index from precomputed fingerprints given
+// as "id<TAB>hex" lines. Empty lines are skipped, malformed ones are reported
+// with their line number.
+func NewSimhashIndexFromHex(r io.Reader, k, f int) (*SimhashIndex, error) {
+	if f%8 != 0 || f <= 0 {
+		return nil, fmt.Errorf("f should be a multiple of 8 and not zero, got %d", f)
+	}
+	index := NewSimhashIndex(nil, SimhashIndexWithK(k), SimhashIndexWithF(f))
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		id, hexVal, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected id<TAB>hex, got %q", lineNo, line)
+		}
+		sim, err := NewSimhashFromHex(hexVal, f)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		index.Add(Object{ObjectId: id, S: sim})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", lineNo+1, err)
+	}
+
+	return index, nil
+}
+
+type jsonlRecord struct {
+	ID   string            `json:"id"`
+	Hash string            `json:"hash"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// ExportJSONL writes every object in the index as a {"id":...,"hash":...}
+// line, the hash being the fixed-width hex fingerprint, with a "tags" object
+// for objects added with tags
+func (s *SimhashIndex) ExportJSONL(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	enc := json.NewEncoder(w)
+	for id, sim := range s.objects {
+		if err := enc.Encode(jsonlRecord{ID: id, Hash: sim.Hex(), Tags: s.tags[id]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportJSONL adds the objects written by ExportJSONL to the index
+func (s *SimhashIndex) ImportJSONL(r io.Reader) error {
+	f := s.F
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var rec jsonlRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		sim, err := NewSimhashFromHex(rec.Hash, f)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		s.Add(Object{ObjectId: rec.ID, S: sim, Tags: rec.Tags})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("line %d: %w", lineNo+1, err)
+	}
+
+	return nil
+}
+
+// compactMagic starts every stream written by SaveCompact
+const (
+	compactMagic   = "SHIX"
+	compactVersion = 2
+)
+
+// SaveCompact writes the index in a compact binary format: a header with the
+// format version, F and K, then every object as a varint length prefixed id
+// followed by its F/8 byte fingerprint and its tags, see appendTags. Buckets
+// are not stored, LoadCompact derives them again.
+func (s *SimhashIndex) SaveCompact(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	buf := append([]byte(compactMagic), compactVersion)
+	buf = binary.AppendUvarint(buf, uint64(s.F))
+	buf = binary.AppendUvarint(buf, uint64(s.K))
+	buf = binary.AppendUvarint(buf, uint64(len(s.objects)))
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+
+	for id, sim := range s.objects {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(id)))
+		buf = append(buf, id...)
+		buf = append(buf, sim.Bytes()...)
+		buf = appendTags(buf, s.tags[id])
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadCompact reads an index written by SaveCompact, the options are applied
+// before F and K are set from the stream. Streams of version 1, written
+// before tags were stored, are read without tags.
+func LoadCompact(r io.Reader, ixOpt ...IndexOptions) (*SimhashIndex, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(compactMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if string(header[:len(compactMagic)]) != compactMagic {
+		return nil, errors.New("not a compact simhash index")
+	}
+	version := header[len(compactMagic)]
+	if version < 1 || version > compactVersion {
+		return nil, fmt.Errorf("unsupported compact index version %d", version)
+	}
+
+	f, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading f: %w", err)
+	}
+	if f == 0 || f%8 != 0 || f > maxStreamF {
+		return nil, fmt.Errorf("invalid f %d", f)
+	}
+	k, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading k: %w", err)
+	}
+	if k >= f {
+		return nil, fmt.Errorf("invalid k %d for f %d", k, f)
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading object count: %w", err)
+	}
+
+	ixOpt = append(ixOpt[:len(ixOpt):len(ixOpt)], SimhashIndexWithF(int(f)), SimhashIndexWithK(int(k)))
+	index := NewSimhashIndex(nil, ixOpt...)
+
+	fp := make([]byte, f/8)
+	for i := range count {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("object %d: reading id length: %w", i, err)
+		}
+		if n > maxLineSize {
+			return nil, fmt.Errorf("object %d: id length %d too large", i, n)
+		}
+		id := make([]byte, n)
+		if _, err := io.ReadFull(br, id); err != nil {
+			return nil, fmt.Errorf("object %d: reading id: %w", i, err)
+		}
+		if _, err := io.ReadFull(br, fp); err != nil {
+			return nil, fmt.Errorf("object %d: reading fingerprint: %w", i, err)
+		}
+		var tags map[string]string
+		if version >= 2 {
+			if tags, err = readTags(br); err != nil {
+				return nil, fmt.Errorf("object %d: reading tags: %w", i, unexpectedEOF(err))
+			}
+		}
+		sim := newSimhash(WithF(int(f)))
+		sim.Value.SetBytes(fp)
+		// loading a snapshot is not an Add, so it is neither counted nor logged
+		index.add(Object{ObjectId: string(id), S: sim, Tags: tags})
+	}
+
+	return index, nil
+}
+
+// objectsMagic starts every stream written by MarshalObjects
+const (
+	objectsMagic   = "SHOB"
+	objectsVersion = 2
+)
+
+// MarshalObjects writes objs to w as a header followed by one record per
+// object: its F, the varint length prefixed id, the F/8 byte fingerprint
+// and its tags, see appendTags. Objects without a fingerprint are rejected.
+func MarshalObjects(objs []Object, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(append([]byte(objectsMagic), objectsVersion)); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for i, obj := range objs {
+		if obj.S == nil {
+			return fmt.Errorf("object %d (%q) has no simhash", i, obj.ObjectId)
+		}
+		buf = appendObject(buf[:0], obj.S.F, obj.ObjectId, obj.S)
+		buf = appendTags(buf, obj.Tags)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// UnmarshalObjects reads objects written by MarshalObjects, in order. Streams
+// of version 1, written before tags were stored, are read without tags.
+func UnmarshalObjects(r io.Reader) ([]Object, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(objectsMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if string(header[:len(objectsMagic)]) != objectsMagic {
+		return nil, errors.New("not a simhash object stream")
+	}
+	version := header[len(objectsMagic)]
+	if version < 1 || version > objectsVersion {
+		return nil, fmt.Errorf("unsupported object stream version %d", version)
+	}
+
+	var objs []Object
+	for {
+		id, sim, err := readObject(br, true)
+		if err == io.EOF {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("object %d: %w", len(objs), err)
+		}
+		var tags map[string]string
+		if version >= 2 {
+			if tags, err = readTags(br); err != nil {
+				return nil, fmt.Errorf("object %d: reading tags: %w", len(objs), unexpectedEOF(err))
+			}
+		}
+		objs = append(objs, Object{ObjectId: id, S: sim, Tags: tags})
+	}
+}
+
+// appendObject appends f, the varint length prefixed id and, unless sim is
+// nil, the fixed-width fingerprint to buf
+func appendObject(buf []byte, f int, id string, sim *Simhash) []byte {
+	buf = binary.AppendUvarint(buf, uint64(f))
+	buf = binary.AppendUvarint(buf, uint64(len(id)))
+	buf = append(buf, id...)
+	if sim != nil {
+		buf = append(buf, sim.Bytes()...)
+	}
+	return buf
+}
+
+// readObject reads a record written by appendObject, withFingerprint telling
+// whether it has a fingerprint. It returns io.EOF only if the input ended
+// before the record, and io.ErrUnexpectedEOF if it ended within it.
+func readObject(br *bufio.Reader, withFingerprint bool) (string, *Simhash, error) {
+	f, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", nil, err
+	}
+	if f == 0 || f%8 != 0 || f > maxStreamF {
+		return "", nil, fmt.Errorf("invalid f %d", f)
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	if n > maxLineSize {
+		return "", nil, fmt.Errorf("id length %d too large", n)
+	}
+	id := make([]byte, n)
+	if _, err := io.ReadFull(br, id); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	if !withFingerprint {
+		return string(id), nil, nil
+	}
+
+	fp := make([]byte, f/8)
+	if _, err := io.ReadFull(br, fp); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	sim := newSimhash(WithF(int(f)))
+	sim.Value.SetBytes(fp)
+	return string(id), sim, nil
+}
+
+// appendTags appends the number of tags followed by every key and value,
+// sorted by key, each varint length prefixed
+func appendTags(buf []byte, tags map[string]string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(tags)))
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		for _, str := range []string{key, tags[key]} {
+			buf = binary.AppendUvarint(buf, uint64(len(str)))
+			buf = append(buf, str...)
+		}
+	}
+	return buf
+}
+
+// readTags reads tags written by appendTags, nil when there are none
+func readTags(br *bufio.Reader) (map[string]string, error) {
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	var tags map[string]string
+	for range count {
+		var pair [2]string
+		for i := range pair {
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, err
+			}
+			if n > maxLineSize {
+				return nil, fmt.Errorf("tag length %d too large", n)
+			}
+			str := make([]byte, n)
+			if _, err := io.ReadFull(br, str); err != nil {
+				return nil, err
+			}
+			pair[i] = string(str)
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[pair[0]] = pair[1]
+	}
+	return tags, nil
+}
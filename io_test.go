@@ -0,0 +1,301 @@
+package simhash_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestIO(t *testing.T) {
+	t.Run("test build index from reader", func(t *testing.T) {
+		corpus := strings.Join([]string{
+			"How are you? I Am fine. blar blar blar blar blar Thankg",
+			"How are you i am fine. blar blar blar blar blar than",
+			"This is simhash test.",
+			"How are you i am fine. blar blar blar blar blar thank1",
+		}, "\n")
+
+		index, err := s.BuildIndexFromReader(strings.NewReader(corpus), func(lineNo int, _ string) string {
+			return strconv.Itoa(lineNo)
+		}, 10, 64)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		dups := index.GetNearDups(s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank"))
+		if len(dups) != 3 {
+			t.Errorf("Expected 3 duplicates, got %d: %v", len(dups), dups)
+		}
+
+		if _, err := s.BuildIndexFromReader(strings.NewReader(corpus), func(lineNo int, _ string) string {
+			return strconv.Itoa(lineNo)
+		}, 2, 63); err == nil || !strings.Contains(err.Error(), "63") {
+			t.Errorf("Expected an error naming f=63, got %v", err)
+		}
+	})
+
+	t.Run("test index from hex", func(t *testing.T) {
+		texts := []string{
+			"How are you? I Am fine. blar blar blar blar blar Thankg",
+			"This is simhash test.",
+		}
+		var lines []string
+		for i, text := range texts {
+			lines = append(lines, strconv.Itoa(i)+"\t"+s.NewSimhash(text).Hex())
+		}
+		lines = append(lines, "")
+
+		index, err := s.NewSimhashIndexFromHex(strings.NewReader(strings.Join(lines, "\n")), 2, 64)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for i, text := range texts {
+			dups := index.GetNearDups(s.NewSimhash(text))
+			if len(dups) != 1 || dups[0] != strconv.Itoa(i) {
+				t.Errorf("Expected [%d], got %v", i, dups)
+			}
+		}
+
+		for _, bad := range []string{"a\tzz", "no tab here", "a\t1ffffffffffffffff"} {
+			_, err := s.NewSimhashIndexFromHex(strings.NewReader("ok\t00ff\n"+bad), 2, 64)
+			if err == nil || !strings.Contains(err.Error(), "line 2") {
+				t.Errorf("Expected a line 2 error for %q, got %v", bad, err)
+			}
+		}
+	})
+
+	t.Run("test jsonl round trip", func(t *testing.T) {
+		var objs []s.Object
+		for i := range 20 {
+			objs = append(objs, s.Object{ObjectId: "doc-" + strconv.Itoa(i), S: s.NewSimhash("document number " + strconv.Itoa(i))})
+		}
+		index := s.NewSimhashIndex(objs, s.SimhashIndexWithK(3))
+
+		var buf bytes.Buffer
+		if err := index.ExportJSONL(&buf); err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		if lines := strings.Count(buf.String(), "\n"); lines != len(objs) {
+			t.Errorf("Expected %d lines, got %d", len(objs), lines)
+		}
+		if !strings.Contains(buf.String(), `{"id":"doc-0","hash":"`+objs[0].S.Hex()+`"}`) {
+			t.Errorf("Expected a line for doc-0, got %s", buf.String())
+		}
+
+		restored := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3))
+		if err := restored.ImportJSONL(&buf); err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if restored.BucketSize() != index.BucketSize() {
+			t.Errorf("Expected %d buckets, got %d", index.BucketSize(), restored.BucketSize())
+		}
+		for _, obj := range objs {
+			dups := restored.GetNearDups(obj.S)
+			if !slices.Contains(dups, obj.ObjectId) {
+				t.Errorf("Expected to find %s, got %v", obj.ObjectId, dups)
+			}
+		}
+
+		err := restored.ImportJSONL(strings.NewReader(`{"id":"x","hash":"00"}` + "\n" + `{"id":`))
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("Expected a line 2 error, got %v", err)
+		}
+	})
+
+	t.Run("test compact round trip", func(t *testing.T) {
+		var objs []s.Object
+		for i := range 1000 {
+			objs = append(objs, s.Object{ObjectId: strconv.Itoa(i), S: s.NewSimhash("document number " + strconv.Itoa(i))})
+		}
+		index := s.NewSimhashIndex(objs, s.SimhashIndexWithK(3))
+
+		var compact bytes.Buffer
+		if err := index.SaveCompact(&compact); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		size := compact.Len()
+
+		restored, err := s.LoadCompact(&compact)
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		if restored.K != 3 || restored.F != 64 || restored.BucketSize() != index.BucketSize() {
+			t.Errorf("Expected k=3 f=64 with %d buckets, got k=%d f=%d with %d", index.BucketSize(), restored.K, restored.F, restored.BucketSize())
+		}
+		if err := restored.Validate(); err != nil {
+			t.Errorf("Expected a valid index, got %v", err)
+		}
+		if !restored.Equal(index) {
+			t.Error("Expected the restored index to equal the original")
+		}
+		for _, obj := range objs[:50] {
+			expected := index.GetNearDups(obj.S)
+			got := restored.GetNearDups(obj.S)
+			slices.Sort(expected)
+			slices.Sort(got)
+			if !slices.Equal(got, expected) {
+				t.Errorf("Expected %v, got %v", expected, got)
+			}
+		}
+
+		var buckets bytes.Buffer
+		if err := gob.NewEncoder(&buckets).Encode(index.Bucket); err != nil {
+			t.Fatalf("Encoding buckets failed: %v", err)
+		}
+		if size*5 > buckets.Len() {
+			t.Errorf("Expected the compact format to be much smaller than the buckets, got %d vs %d bytes", size, buckets.Len())
+		}
+
+		if _, err := s.LoadCompact(strings.NewReader("nope")); err == nil {
+			t.Error("Expected an error for a bad header")
+		}
+		huge := binary.AppendUvarint([]byte("SHIX\x02"), 1<<24)
+		if _, err := s.LoadCompact(bytes.NewReader(huge)); err == nil || !strings.Contains(err.Error(), "invalid f") {
+			t.Errorf("Expected an invalid f error, got %v", err)
+		}
+		truncated := bytes.NewBuffer(nil)
+		index.SaveCompact(truncated)
+		if _, err := s.LoadCompact(bytes.NewReader(truncated.Bytes()[:truncated.Len()-3])); err == nil {
+			t.Error("Expected an error for a truncated stream")
+		}
+	})
+
+	t.Run("test tags survive a reload", func(t *testing.T) {
+		var objs []s.Object
+		for i := range 20 {
+			tenant := []string{"acme", "globex"}[i%2]
+			objs = append(objs, s.Object{ObjectId: strconv.Itoa(i), S: s.NewSimhash("document number " + strconv.Itoa(i)), Tags: map[string]string{"tenant": tenant}})
+		}
+		objs[0].Tags = nil
+		var wal bytes.Buffer
+		index := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3), s.SimhashIndexWithWAL(&wal))
+		for _, obj := range objs {
+			index.Add(obj)
+		}
+		acme := map[string]string{"tenant": "acme"}
+		filtered := func(ix interface {
+			GetNearDupsFiltered(*s.Simhash, map[string]string) []string
+		}) []string {
+			var ids []string
+			for _, obj := range objs {
+				ids = append(ids, ix.GetNearDupsFiltered(obj.S, acme)...)
+			}
+			slices.Sort(ids)
+			return slices.Compact(ids)
+		}
+		expected := filtered(index)
+		if len(expected) != 9 {
+			t.Fatalf("Expected the 9 tagged acme objects, got %v", expected)
+		}
+
+		var jsonl bytes.Buffer
+		if err := index.ExportJSONL(&jsonl); err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+		fromJSONL := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3))
+		if err := fromJSONL.ImportJSONL(&jsonl); err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if got := filtered(fromJSONL); !slices.Equal(got, expected) {
+			t.Errorf("Expected %v after ImportJSONL, got %v", expected, got)
+		}
+
+		var compact bytes.Buffer
+		if err := index.SaveCompact(&compact); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		fromCompact, err := s.LoadCompact(&compact)
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		if got := filtered(fromCompact); !slices.Equal(got, expected) {
+			t.Errorf("Expected %v after LoadCompact, got %v", expected, got)
+		}
+
+		var marshaled bytes.Buffer
+		if err := s.MarshalObjects(objs, &marshaled); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		unmarshaled, err := s.UnmarshalObjects(&marshaled)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if got := filtered(s.NewSimhashIndex(unmarshaled, s.SimhashIndexWithK(3))); !slices.Equal(got, expected) {
+			t.Errorf("Expected %v after UnmarshalObjects, got %v", expected, got)
+		}
+
+		replayed := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3))
+		if err := s.ReplayWAL(replayed, &wal); err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		if got := filtered(replayed); !slices.Equal(got, expected) {
+			t.Errorf("Expected %v after ReplayWAL, got %v", expected, got)
+		}
+
+		if got := filtered(s.NewShardedSimhashIndex(objs, 4, s.SimhashIndexWithK(3))); !slices.Equal(got, expected) {
+			t.Errorf("Expected %v from the sharded index, got %v", expected, got)
+		}
+
+		// version 1 streams, written before tags were stored, still load
+		v1 := append([]byte("SHIX\x01\x40\x03\x01\x01x"), objs[1].S.Bytes()...)
+		old, err := s.LoadCompact(bytes.NewReader(v1))
+		if err != nil {
+			t.Fatalf("Loading a version 1 stream failed: %v", err)
+		}
+		if dups := old.GetNearDups(objs[1].S); !slices.Equal(dups, []string{"x"}) {
+			t.Errorf("Expected [x] from a version 1 stream, got %v", dups)
+		}
+	})
+
+	t.Run("test marshal objects", func(t *testing.T) {
+		objs := []s.Object{
+			{ObjectId: "first", S: s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg")},
+			{ObjectId: "", S: s.NewSimhash("This is simhash test.", s.WithF(128))},
+			{ObjectId: "third, with a comma", S: s.NewSimhash(int64(0))},
+		}
+
+		var buf bytes.Buffer
+		if err := s.MarshalObjects(objs, &buf); err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		got, err := s.UnmarshalObjects(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if len(got) != len(objs) {
+			t.Fatalf("Expected %d objects, got %d", len(objs), len(got))
+		}
+		for i, obj := range got {
+			if obj.ObjectId != objs[i].ObjectId || obj.S.F != objs[i].S.F || !obj.S.Equal(objs[i].S) {
+				t.Errorf("Expected %q %s, got %q %s", objs[i].ObjectId, objs[i].S, obj.ObjectId, obj.S)
+			}
+		}
+
+		// rebuilding indexes with another K needs no fingerprinting
+		index := s.NewSimhashIndex(got[:1], s.SimhashIndexWithK(5))
+		if dups := index.GetNearDups(objs[0].S); !slices.Equal(dups, []string{"first"}) {
+			t.Errorf("Expected [first], got %v", dups)
+		}
+
+		if _, err := s.UnmarshalObjects(bytes.NewReader(buf.Bytes()[:buf.Len()-2])); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected io.ErrUnexpectedEOF for a truncated stream, got %v", err)
+		}
+		if err := s.MarshalObjects([]s.Object{{ObjectId: "x"}}, io.Discard); err == nil {
+			t.Error("Expected an error for an object without a simhash")
+		}
+
+		// an F of 1<<24 would ask for a 2MiB fingerprint
+		huge := binary.AppendUvarint([]byte("SHOB\x02"), 1<<24)
+		if _, err := s.UnmarshalObjects(bytes.NewReader(huge)); err == nil || !strings.Contains(err.Error(), "invalid f") {
+			t.Errorf("Expected an invalid f error, got %v", err)
+		}
+	})
+}
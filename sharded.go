@@ -0,0 +1,304 @@
+package simhash
+
+import (
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"maps"
+	"math/big"
+	"slices"
+	"sync"
+)
+
+// Index is the set of operations shared by SimhashIndex and
+// ShardedSimhashIndex
+type Index interface {
+	Add(obj Object)
+	Delete(obj Object)
+	Update(objectID string, newSim *Simhash) error
+	GetNearDups(simhash *Simhash) []string
+	GetNearDupsK(simhash *Simhash, k int) []string
+	Range(fn func(objectID string, sim *Simhash) bool)
+	BucketSize() int
+}
+
+var (
+	_ Index = (*SimhashIndex)(nil)
+	_ Index = (*ShardedSimhashIndex)(nil)
+)
+
+// ShardedSimhashIndex is a SimhashIndex whose buckets are partitioned across
+// shards by a hash of the bucket key, each shard with its own lock, so writes
+// touching different shards proceed in parallel and a query only locks the
+// shards owning its K+1 keys. Object ids, their fingerprints and tags are
+// tracked in the shard their id hashes to. It accepts the options of
+// NewSimhashIndex, except that buckets are never kept sorted.
+type ShardedSimhashIndex struct {
+	K   int
+	F   int
+	Log *slog.Logger
+
+	// cfg holds the options, it is never modified after construction
+	cfg    *SimhashIndex
+	wal    io.Writer
+	shards []*indexShard
+}
+
+type indexShard struct {
+	mu     sync.RWMutex
+	bucket map[string]map[string]string
+
+	// idMu guards the objects whose id hashes to this shard, writers hold
+	// it for the whole change and always take it before any bucket lock
+	idMu    sync.RWMutex
+	objects map[string]*Simhash
+	tags    map[string]map[string]string
+}
+
+// NewShardedSimhashIndex builds a sharded index with the given number of
+// shards, accepting the same options as NewSimhashIndex. A write-ahead log
+// is shared by the shards, its records written one at a time.
+func NewShardedSimhashIndex(objs []Object, shards int, ixOpt ...IndexOptions) *ShardedSimhashIndex {
+	cfg := NewSimhashIndex(nil, ixOpt...)
+	if shards < 1 {
+		cfg.Log.Error("shards should be at least 1\ngot", "shards:", shards)
+		shards = 1
+	}
+
+	s := &ShardedSimhashIndex{
+		K:      cfg.K,
+		F:      cfg.F,
+		Log:    cfg.Log,
+		cfg:    cfg,
+		shards: make([]*indexShard, shards),
+	}
+	if cfg.wal != nil {
+		s.wal = &lockedWriter{w: cfg.wal}
+	}
+	for i := range s.shards {
+		s.shards[i] = &indexShard{
+			bucket:  map[string]map[string]string{},
+			objects: map[string]*Simhash{},
+			tags:    map[string]map[string]string{},
+		}
+	}
+
+	for _, obj := range objs {
+		s.Add(obj)
+	}
+
+	return s
+}
+
+// lockedWriter serializes the writes of the shards to a shared writer
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func (s *ShardedSimhashIndex) shard(key string) *indexShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// logWAL appends a record to the shared write-ahead log, if any, see
+// SimhashIndex.logWAL. The caller holds the id lock, so the records of an
+// object are written in the order its changes are applied.
+func (s *ShardedSimhashIndex) logWAL(op byte, objectID string, sim *Simhash, tags map[string]string) {
+	if s.wal == nil {
+		return
+	}
+	if op == walAdd && len(tags) > 0 {
+		op = walAddTagged
+	}
+	buf := appendObject([]byte{op}, s.F, objectID, sim)
+	if op == walAddTagged {
+		buf = appendTags(buf, tags)
+	}
+	if _, err := s.wal.Write(buf); err != nil {
+		s.Log.Error("writing the write-ahead log failed", "op", string(op), "id", objectID, "err", err)
+	}
+}
+
+// Add inserts obj into the index, replacing any other fingerprint stored
+// under the same object id
+func (s *ShardedSimhashIndex) Add(obj Object) {
+	if obj.S == nil || obj.S.F != s.F {
+		return
+	}
+
+	owner := s.shard(obj.ObjectId)
+	owner.idMu.Lock()
+	defer owner.idMu.Unlock()
+
+	s.logWAL(walAdd, obj.ObjectId, obj.S, obj.Tags)
+	s.put(owner, obj.ObjectId, obj.S, obj.Tags)
+}
+
+// put stores sim and tags under objectID, the caller holds owner.idMu
+func (s *ShardedSimhashIndex) put(owner *indexShard, objectID string, sim *Simhash, tags map[string]string) {
+	sim = bareSimhash(new(big.Int).Set(sim.Value), s.F)
+	if s.cfg.ignoreMask != nil {
+		sim.Value.AndNot(sim.Value, s.cfg.ignoreMask)
+	}
+	if old, ok := owner.objects[objectID]; ok && !old.Equal(sim) {
+		s.removeEntry(objectID, old)
+	}
+	val := bucketEntry(objectID, sim)
+	for _, key := range s.cfg.keys(sim) {
+		sh := s.shard(key)
+		sh.mu.Lock()
+		if sh.bucket[key] == nil {
+			sh.bucket[key] = make(map[string]string)
+		}
+		sh.bucket[key][val] = val
+		sh.mu.Unlock()
+	}
+	owner.objects[objectID] = sim
+	if tags != nil {
+		owner.tags[objectID] = maps.Clone(tags)
+	} else {
+		delete(owner.tags, objectID)
+	}
+}
+
+func (s *ShardedSimhashIndex) Delete(obj Object) {
+	if obj.S == nil || obj.S.F != s.F {
+		return
+	}
+
+	owner := s.shard(obj.ObjectId)
+	owner.idMu.Lock()
+	defer owner.idMu.Unlock()
+
+	s.logWAL(walDelete, obj.ObjectId, obj.S, nil)
+	sim := s.cfg.masked(obj.S)
+	s.removeEntry(obj.ObjectId, sim)
+	if old, ok := owner.objects[obj.ObjectId]; ok && old.Equal(sim) {
+		delete(owner.objects, obj.ObjectId)
+		delete(owner.tags, obj.ObjectId)
+	}
+}
+
+// Update replaces the fingerprint stored for objectID, see SimhashIndex.Update
+func (s *ShardedSimhashIndex) Update(objectID string, newSim *Simhash) error {
+	if newSim == nil || newSim.F != s.F {
+		return ErrDimensionMismatch
+	}
+
+	owner := s.shard(objectID)
+	owner.idMu.Lock()
+	defer owner.idMu.Unlock()
+
+	if _, ok := owner.objects[objectID]; !ok {
+		return ErrObjectNotFound
+	}
+	tags := owner.tags[objectID]
+	s.logWAL(walAdd, objectID, newSim, tags)
+	s.put(owner, objectID, newSim, tags)
+	return nil
+}
+
+func (s *ShardedSimhashIndex) removeEntry(objectID string, sim *Simhash) {
+	val := bucketEntry(objectID, sim)
+	for _, key := range s.cfg.keys(sim) {
+		sh := s.shard(key)
+		sh.mu.Lock()
+		if _, ok := sh.bucket[key]; ok {
+			delete(sh.bucket[key], val)
+			if len(sh.bucket[key]) == 0 {
+				delete(sh.bucket, key)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// GetNearDups looks the query's keys up in their shards and merges the
+// matches within K
+func (s *ShardedSimhashIndex) GetNearDups(simhash *Simhash) []string {
+	return slices.Collect(maps.Keys(s.matches(simhash, s.K)))
+}
+
+// GetNearDupsK is like GetNearDups but filters candidates with tolerance k,
+// see SimhashIndex.GetNearDupsK
+func (s *ShardedSimhashIndex) GetNearDupsK(simhash *Simhash, k int) []string {
+	if limit := s.cfg.numBlocks() - 1; k > limit {
+		s.Log.Warn("query tolerance exceeds the index recall guarantee, some duplicates may be missed", "k", k, "guaranteed", limit)
+	}
+	return slices.Collect(maps.Keys(s.matches(simhash, k)))
+}
+
+// GetNearDupsFiltered returns the objects within K of simhash whose tags
+// contain every key and value of match, see SimhashIndex.GetNearDupsFiltered
+func (s *ShardedSimhashIndex) GetNearDupsFiltered(simhash *Simhash, match map[string]string) []string {
+	var ans []string
+	for id := range s.matches(simhash, s.K) {
+		owner := s.shard(id)
+		owner.idMu.RLock()
+		ok := tagsMatch(owner.tags[id], match)
+		owner.idMu.RUnlock()
+		if ok {
+			ans = append(ans, id)
+		}
+	}
+	return ans
+}
+
+// matches returns the ids within k of simhash found in the buckets of its
+// keys, locking only the shards owning them
+func (s *ShardedSimhashIndex) matches(simhash *Simhash, k int) map[string]struct{} {
+	if simhash.F != s.F {
+		return nil
+	}
+	simhash = s.cfg.masked(simhash)
+
+	result := make(map[string]struct{})
+	for _, key := range s.cfg.keys(simhash) {
+		sh := s.shard(key)
+		sh.mu.RLock()
+		for val := range sh.bucket[key] {
+			objID, dup, ok := parseEntry(val, s.F)
+			if ok && simhash.Distance(dup) <= k {
+				result[objID] = struct{}{}
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return result
+}
+
+// Range calls fn for every object in the index, see SimhashIndex.Range. Each
+// shard's objects are read locked while ranging over them, so fn must not
+// modify the index.
+func (s *ShardedSimhashIndex) Range(fn func(objectID string, sim *Simhash) bool) {
+	for _, sh := range s.shards {
+		sh.idMu.RLock()
+		for id, sim := range sh.objects {
+			if !fn(id, bareSimhash(new(big.Int).Set(sim.Value), sim.F)) {
+				sh.idMu.RUnlock()
+				return
+			}
+		}
+		sh.idMu.RUnlock()
+	}
+}
+
+// BucketSize returns the number of buckets, a bucket key lives in a single
+// shard
+func (s *ShardedSimhashIndex) BucketSize() int {
+	total := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		total += len(sh.bucket)
+		sh.mu.RUnlock()
+	}
+	return total
+}
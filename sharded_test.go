@@ -0,0 +1,131 @@
+package simhash_test
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"math/big"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestShardedSimhashIndex(t *testing.T) {
+	data := []string{
+		"How are you? I Am fine. blar blar blar blar blar Thankg",
+		"How are you i am fine. blar blar blar blar blar than",
+		"This is simhash test.",
+		"How are you i am fine. blar blar blar blar blar thank1",
+	}
+
+	var objs []s.Object
+	for i, txt := range data {
+		objs = append(objs, s.Object{ObjectId: strconv.Itoa(i + 1), S: s.NewSimhash(txt)})
+	}
+
+	t.Run("test matches simhash index", func(t *testing.T) {
+		plain := s.NewSimhashIndex(objs, s.SimhashIndexWithK(10))
+		sharded := s.NewShardedSimhashIndex(objs, 4, s.SimhashIndexWithK(10))
+
+		q := s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank")
+		expected := plain.GetNearDups(q)
+		got := sharded.GetNearDups(q)
+		slices.Sort(expected)
+		slices.Sort(got)
+		if !slices.Equal(got, expected) {
+			t.Errorf("Expected %v, got %v", expected, got)
+		}
+		if plain.BucketSize() != sharded.BucketSize() {
+			t.Errorf("Expected %d buckets, got %d", plain.BucketSize(), sharded.BucketSize())
+		}
+
+		sharded.Delete(objs[0])
+		if dups := sharded.GetNearDups(q); len(dups) != 2 {
+			t.Errorf("After deleting ID=1, expected 2 duplicates, got %v", dups)
+		}
+	})
+
+	t.Run("test concurrent writes", func(t *testing.T) {
+		var index s.Index = s.NewShardedSimhashIndex(nil, 8)
+
+		var wg sync.WaitGroup
+		for w := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 100 {
+					id := strconv.Itoa(w*100 + i)
+					index.Add(s.Object{ObjectId: id, S: s.NewSimhash("document " + id)})
+				}
+			}()
+		}
+		wg.Wait()
+
+		for _, id := range []string{"0", "450", "799"} {
+			dups := index.GetNearDups(s.NewSimhash("document " + id))
+			if !slices.Contains(dups, id) {
+				t.Errorf("Expected to find %s, got %v", id, dups)
+			}
+		}
+	})
+
+	t.Run("test options reach the shards", func(t *testing.T) {
+		var wal bytes.Buffer
+		mask := new(big.Int).SetUint64(0xff)
+		opts := []s.IndexOptions{s.SimhashIndexWithK(3), s.SimhashIndexWithIgnoreMask(mask), s.SimhashIndexWithWAL(&wal)}
+		sharded := s.NewShardedSimhashIndex(objs, 4, opts...)
+
+		// the ignored low byte doesn't count toward the distance
+		q := s.NewSimhash(new(big.Int).Xor(objs[2].S.Value, big.NewInt(0xff)))
+		if dups := sharded.GetNearDups(q); !slices.Equal(dups, []string{"3"}) {
+			t.Errorf("Expected [3] with the low byte ignored, got %v", dups)
+		}
+
+		if err := sharded.Update("3", objs[0].S); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if err := sharded.Update("missing", objs[0].S); !errors.Is(err, s.ErrObjectNotFound) {
+			t.Errorf("Expected ErrObjectNotFound, got %v", err)
+		}
+		sharded.Delete(objs[1])
+
+		replayed := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3), s.SimhashIndexWithIgnoreMask(mask))
+		if err := s.ReplayWAL(replayed, &wal); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		ranged := map[string]string{}
+		sharded.Range(func(id string, sim *s.Simhash) bool {
+			ranged[id] = sim.Hex()
+			return true
+		})
+		expected := map[string]string{}
+		replayed.Range(func(id string, sim *s.Simhash) bool {
+			expected[id] = sim.Hex()
+			return true
+		})
+		if !maps.Equal(ranged, expected) || len(ranged) != 3 {
+			t.Errorf("Expected the replayed log to hold %v, got %v", ranged, expected)
+		}
+
+		calls := 0
+		sharded.Range(func(string, *s.Simhash) bool {
+			calls++
+			return false
+		})
+		if calls != 1 {
+			t.Errorf("Expected Range to stop after the first object, got %d calls", calls)
+		}
+
+		near := s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank")
+		plain := s.NewSimhashIndex(objs, s.SimhashIndexWithK(3))
+		expectedK, gotK := plain.GetNearDupsK(near, 1), s.NewShardedSimhashIndex(objs, 4, s.SimhashIndexWithK(3)).GetNearDupsK(near, 1)
+		slices.Sort(expectedK)
+		slices.Sort(gotK)
+		if !slices.Equal(gotK, expectedK) {
+			t.Errorf("Expected %v, got %v", expectedK, gotK)
+		}
+	})
+}
@@ -1,10 +1,24 @@
 package simhash_test
 
 import (
+	"bytes"
 	"crypto/md5"
 	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"math"
 	"math/big"
+	"math/bits"
+	"math/rand/v2"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	s "github.com/suryanshu-09/simhash"
@@ -101,6 +115,1282 @@ func TestSimhash(t *testing.T) {
 		}
 	})
 
+	t.Run("test normalize and fingerprint", func(t *testing.T) {
+		a, normA := s.NormalizeAndFingerprint("Hello, World!")
+		b, normB := s.NormalizeAndFingerprint("hello world")
+
+		if normA != "helloworld" || normA != normB {
+			t.Errorf("Expected both to normalize to helloworld, got %q and %q", normA, normB)
+		}
+		if !a.Equal(b) {
+			t.Error("Texts differing only in case and punctuation should be equal")
+		}
+		if !a.Equal(s.NewSimhash("Hello, World!")) {
+			t.Error("NormalizeAndFingerprint should match NewSimhash")
+		}
+
+		words, normWords := s.NormalizeAndFingerprint("Hello, World!", s.WithWordTokenizer())
+		if normWords != "hello world" || !words.Equal(s.NewSimhash("Hello, World!", s.WithWordTokenizer())) {
+			t.Errorf("Expected the word tokens hello world, got %q", normWords)
+		}
+	})
+
+	t.Run("test gob round trip", func(t *testing.T) {
+		objs := []s.Object{
+			{ObjectId: "a", S: s.NewSimhash("How are you? I AM fine.")},
+			{ObjectId: "b", S: s.NewSimhash("How are you? I AM fine.", s.WithF(128))},
+			{ObjectId: "c", S: s.NewSimhash(int64(1))},
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(objs); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+
+		var decoded []s.Object
+		if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+
+		if len(decoded) != len(objs) {
+			t.Fatalf("Expected %d objects, got %d", len(objs), len(decoded))
+		}
+		for i, obj := range objs {
+			got := decoded[i]
+			if got.ObjectId != obj.ObjectId || got.S.F != obj.S.F || !got.S.Equal(obj.S) {
+				t.Errorf("Object %d did not round trip: got %s/%d/%x", i, got.ObjectId, got.S.F, got.S.Value)
+			}
+			if got.S.Distance(obj.S) != 0 {
+				t.Errorf("Decoded object %d should be comparable to the original", i)
+			}
+		}
+	})
+
+	t.Run("test similar pairs", func(t *testing.T) {
+		texts := []string{
+			"How are you? I Am fine. ablar ablar xyz blar blar blar blar blar blar blar Thank",
+			"This is a completely different sentence about simhash.",
+			"How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank",
+		}
+		var hashes []*s.Simhash
+		for _, text := range texts {
+			hashes = append(hashes, s.NewSimhash(text))
+		}
+
+		if sim := hashes[0].Similarity(hashes[0]); sim != 1 {
+			t.Errorf("Expected similarity 1 for identical hashes, got %f", sim)
+		}
+
+		pairs := s.SimilarPairs(hashes, 0.85)
+		if len(pairs) != 1 || pairs[0] != [2]int{0, 2} {
+			t.Errorf("Expected only pair [0 2], got %v", pairs)
+		}
+
+		var many []*s.Simhash
+		for i := range 600 {
+			many = append(many, s.NewSimhash("document number "+strconv.Itoa(i/2)))
+		}
+		pairs = s.SimilarPairs(many, 0.95)
+		var expected [][2]int
+		for i := range many {
+			for j := i + 1; j < len(many); j++ {
+				if many[i].Similarity(many[j]) >= 0.95 {
+					expected = append(expected, [2]int{i, j})
+				}
+			}
+		}
+		if len(pairs) != len(expected) || len(pairs) < 300 {
+			t.Fatalf("Expected %d pairs, got %d", len(expected), len(pairs))
+		}
+		for i := range pairs {
+			if pairs[i] != expected[i] {
+				t.Fatalf("Pair %d: expected %v, got %v", i, expected[i], pairs[i])
+			}
+		}
+	})
+
+	t.Run("test invalid f", func(t *testing.T) {
+		sh := s.NewSimhash("hello world", s.WithF(63))
+		if sh.F != 64 {
+			t.Errorf("NewSimhash should reset an invalid f to 64, got %d", sh.F)
+		}
+		if neg := s.NewSimhash("hello world", s.WithF(-8)); neg.F != 64 {
+			t.Errorf("NewSimhash should reset a negative f to 64, got %d", neg.F)
+		}
+		if _, err := s.NewSimhashErr("hello world", s.WithF(-8)); err == nil {
+			t.Error("Expected an error for f=-8")
+		}
+
+		_, err := s.NewSimhashErr("hello world", s.WithF(63))
+		if err == nil {
+			t.Fatal("Expected an error for f=63")
+		}
+		if !strings.Contains(err.Error(), "63") {
+			t.Errorf("Error should name the offending value, got %q", err)
+		}
+
+		if _, err := s.NewSimhashErr(3.14); err == nil {
+			t.Error("Expected an error for an unsupported value type")
+		}
+
+		sh2, err := s.NewSimhashErr("hello world", s.WithF(128))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !sh2.Equal(s.NewSimhash("hello world", s.WithF(128))) {
+			t.Error("NewSimhashErr should match NewSimhash for valid input")
+		}
+	})
+
+	t.Run("test subtract", func(t *testing.T) {
+		base := map[string]int{"aaa": 3, "bbb": 1, "ccc": 2}
+		extra := map[string]int{"ddd": 4, "eee": 60}
+
+		combined := make(map[string]int)
+		for k, v := range base {
+			combined[k] = v
+		}
+		for k, v := range extra {
+			combined[k] = v
+		}
+
+		sh := s.NewSimhash(combined)
+		if err := sh.Subtract(extra); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !sh.Equal(s.NewSimhash(base)) {
+			t.Errorf("Expected %x after subtraction, got %x", s.NewSimhash(base).Value, sh.Value)
+		}
+
+		if err := sh.Subtract(map[string]int{"aaa": 100}); err == nil {
+			t.Error("Expected an error when total weight would go negative")
+		}
+
+		if err := s.NewSimhash(int64(42)).Subtract(base); err == nil {
+			t.Error("Expected an error for a simhash not built from features")
+		}
+	})
+
+	t.Run("test proto round trip", func(t *testing.T) {
+		for _, f := range []int{8, 64, 128} {
+			sh := s.NewSimhash("How are you? I AM fine.", s.WithF(f))
+			pf, data := sh.ToProto()
+			if int(pf) != f || len(data) != f/8 {
+				t.Fatalf("Expected f %d with %d bytes, got %d with %d bytes", f, f/8, pf, len(data))
+			}
+
+			got, err := s.FromProto(pf, data)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got.F != f || !got.Equal(sh) {
+				t.Errorf("f=%d did not round trip: got %x, expected %x", f, got.Value, sh.Value)
+			}
+		}
+
+		if _, err := s.FromProto(64, make([]byte, 4)); err == nil {
+			t.Error("Expected an error for a short payload")
+		}
+		if _, err := s.FromProto(12, make([]byte, 1)); err == nil {
+			t.Error("Expected an error for an invalid f")
+		}
+	})
+
+	t.Run("test similarity kernels", func(t *testing.T) {
+		a := s.NewSimhash(int64(0))
+		b := s.NewSimhash(int64(0xFFFF))
+
+		if sim := a.Similarity(b); sim != 0.75 {
+			t.Errorf("Expected linear similarity 0.75, got %f", sim)
+		}
+		if sim := s.SimilarityWith(a, b, s.LinearKernel); sim != a.Similarity(b) {
+			t.Errorf("LinearKernel should match Similarity, got %f", sim)
+		}
+		if sim := s.SimilarityWith(a, b, s.CosineKernel); math.Abs(sim-math.Cos(math.Pi/4)) > 1e-9 {
+			t.Errorf("Expected cosine similarity %f, got %f", math.Cos(math.Pi/4), sim)
+		}
+		if sim := s.SimilarityWith(a, b, s.GaussianKernel(16)); math.Abs(sim-math.Exp(-1)) > 1e-9 {
+			t.Errorf("Expected gaussian similarity %f, got %f", math.Exp(-1), sim)
+		}
+		if sim := s.SimilarityWith(a, a, s.CosineKernel); sim != 1 {
+			t.Errorf("Expected cosine similarity 1 for identical hashes, got %f", sim)
+		}
+	})
+
+	t.Run("test retain features", func(t *testing.T) {
+		if f := s.NewSimhash("hello world").Features(); f != nil {
+			t.Errorf("Features should be nil without WithRetainFeatures, got %v", f)
+		}
+
+		sh := s.NewSimhash("hello hello", s.WithRetainFeatures())
+		expected := map[string]int{"hell": 2, "ello": 2, "lloh": 1, "lohe": 1, "ohel": 1}
+		if !maps.Equal(sh.Features(), expected) {
+			t.Errorf("Expected features %v, got %v", expected, sh.Features())
+		}
+		if !sh.Equal(s.NewSimhash("hello hello")) {
+			t.Error("Retaining features should not change the fingerprint")
+		}
+
+		if err := sh.Subtract(map[string]int{"hell": 1, "lloh": 1}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected = map[string]int{"hell": 1, "ello": 2, "lohe": 1, "ohel": 1}
+		if !maps.Equal(sh.Features(), expected) {
+			t.Errorf("Expected features %v after subtract, got %v", expected, sh.Features())
+		}
+	})
+
+	t.Run("test fold", func(t *testing.T) {
+		text := "How are you? I AM fine. Thank And you?"
+
+		a := s.NewSimhash(text, s.WithF(256), s.WithFold())
+		if a.Value.Sign() == 0 || a.Value.BitLen() <= 128 {
+			t.Errorf("Expected a full width 256-bit fingerprint with MD5, got %x", a.Value)
+		}
+		b := s.NewSimhash("How old are you ? :-) i am fine. Thank And you?", s.WithF(256), s.WithFold())
+		if d := a.Distance(b); d == 0 || d > 128 {
+			t.Errorf("Expected a small non zero distance for similar texts, got %d", d)
+		}
+
+		folded := s.NewSimhash(text, s.WithF(32), s.WithFold())
+		if folded.Value.BitLen() > 32 || folded.Value.Sign() == 0 {
+			t.Errorf("Expected a 32-bit folded fingerprint, got %x", folded.Value)
+		}
+		if folded.Equal(s.NewSimhash(text, s.WithF(32))) {
+			t.Error("Folding should differ from taking the trailing bytes")
+		}
+
+		if !s.NewSimhash(text, s.WithF(128), s.WithFold()).Equal(s.NewSimhash(text, s.WithF(128))) {
+			t.Error("Folding a digest of exactly FBytes should not change it")
+		}
+	})
+
+	t.Run("test hex", func(t *testing.T) {
+		sh := s.NewSimhash(int64(0xabc), s.WithF(32))
+		if got := sh.Hex(); got != "00000abc" {
+			t.Errorf("Expected zero padded hex 00000abc, got %s", got)
+		}
+
+		back, err := s.NewSimhashFromHex(sh.Hex(), 32)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if back.F != 32 || !back.Equal(sh) {
+			t.Errorf("Hex did not round trip, got %x with f %d", back.Value, back.F)
+		}
+
+		if _, err := s.NewSimhashFromHex("xyz", 64); err == nil {
+			t.Error("Expected an error for invalid hex")
+		}
+		if _, err := s.NewSimhashFromHex("1ff", 8); err == nil {
+			t.Error("Expected an error for hex wider than f")
+		}
+	})
+
+	t.Run("test workers", func(t *testing.T) {
+		features := make(map[string]int)
+		for i := range 20000 {
+			features[strconv.Itoa(i)] = i%120 + 1
+		}
+
+		sequential := s.NewSimhash(features, s.WithWorkers(1))
+		for _, n := range []int{2, 3, 16} {
+			if sh := s.NewSimhash(features, s.WithWorkers(n)); !sh.Equal(sequential) {
+				t.Errorf("%d workers produced %x, expected %x", n, sh.Value, sequential.Value)
+			}
+		}
+
+		if _, err := s.NewSimhashErr(features, s.WithWorkers(0)); err == nil {
+			t.Error("Expected an error for zero workers")
+		}
+	})
+
+	t.Run("test short hash output", func(t *testing.T) {
+		_, err := s.NewSimhashErr("How are you? I AM fine.", s.WithF(256))
+		if err == nil || !strings.Contains(err.Error(), "16 bytes") {
+			t.Errorf("Expected an error about the 16 byte md5 output, got %v", err)
+		}
+
+		if _, err := s.NewSimhashErr("How are you? I AM fine.", s.WithF(256), s.WithFold()); err != nil {
+			t.Errorf("Folding should accept a short hash, got %v", err)
+		}
+
+		sh := s.NewSimhash("How are you? I AM fine.", s.WithF(256), s.WithLogger(slog.New(slog.DiscardHandler)))
+		if !sh.Equal(s.NewSimhash("How are you? I AM fine.", s.WithF(256), s.WithFold())) {
+			t.Error("NewSimhash should fall back to folding a short hash")
+		}
+	})
+
+	t.Run("test bit entropy", func(t *testing.T) {
+		skewed := []*s.Simhash{s.NewSimhash(int64(1)), s.NewSimhash(int64(3)), s.NewSimhash(int64(0))}
+		fractions := s.BitEntropy(skewed)
+		if len(fractions) != 64 {
+			t.Fatalf("Expected 64 positions, got %d", len(fractions))
+		}
+		if math.Abs(fractions[0]-2.0/3) > 1e-9 || math.Abs(fractions[1]-1.0/3) > 1e-9 || fractions[2] != 0 {
+			t.Errorf("Unexpected fractions %v", fractions[:3])
+		}
+
+		var corpus []*s.Simhash
+		for i := range 2000 {
+			n := strconv.Itoa(i)
+			corpus = append(corpus, s.NewSimhash([]string{"a" + n, "b" + n, "c" + n}))
+		}
+		for i, frac := range s.BitEntropy(corpus) {
+			if frac < 0.35 || frac > 0.65 {
+				t.Errorf("Bit %d is skewed: %f", i, frac)
+			}
+		}
+	})
+
+	t.Run("test compare across f", func(t *testing.T) {
+		quiet := s.WithLogger(slog.New(slog.DiscardHandler))
+		text := "How are you? I AM fine. Thank And you?"
+		small := s.NewSimhash(text, s.WithF(32), quiet)
+		large := s.NewSimhash(text, s.WithF(64), quiet)
+
+		truncated, err := large.Truncate(32)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if truncated.F != 32 || !truncated.Equal(small) {
+			t.Errorf("Truncating to 32 bits should match building with f=32, got %x and %x", truncated.Value, small.Value)
+		}
+
+		d, err := s.CompareAcrossF(small, large)
+		if err != nil || d != 0 {
+			t.Errorf("Expected distance 0 for the same text, got %d, %v", d, err)
+		}
+
+		other := s.NewSimhash("How old are you ? :-) i am fine. Thank And you?", s.WithF(64), quiet)
+		d, err = s.CompareAcrossF(other, small)
+		if err != nil || d != small.Distance(s.NewSimhash("How old are you ? :-) i am fine. Thank And you?", s.WithF(32))) {
+			t.Errorf("Unexpected distance %d, %v", d, err)
+		}
+
+		if _, err := s.CompareAcrossF(s.NewSimhash(text, s.WithF(8)), large); err == nil {
+			t.Error("Expected an error when dimensions differ by more than 4x")
+		}
+		if _, err := small.Truncate(64); err == nil {
+			t.Error("Expected an error when truncating to a larger f")
+		}
+	})
+
+	t.Run("test pipeline", func(t *testing.T) {
+		_, norm := s.NormalizeAndFingerprint("Hello World")
+		_, custom := s.NormalizeAndFingerprint("Hello World", s.WithPipeline([]s.Step{s.LowercaseStep, s.RegexStep}))
+		if norm != custom || norm != "helloworld" {
+			t.Errorf("The default pipeline should lowercase then filter, got %q and %q", norm, custom)
+		}
+
+		if _, kept := s.NormalizeAndFingerprint("Hello World", s.WithoutLowercase()); kept != "HelloWorld" {
+			t.Errorf("Expected case to be kept, got %q", kept)
+		}
+
+		upperOnly := s.WithRegexPattern(`[A-Z]+`)
+		_, lowerFirst := s.NormalizeAndFingerprint("Hello World", upperOnly)
+		_, regexFirst := s.NormalizeAndFingerprint("Hello World", upperOnly, s.WithPipeline([]s.Step{s.RegexStep, s.LowercaseStep}))
+		if lowerFirst != "" || regexFirst != "hw" {
+			t.Errorf("Expected step order to matter for a case sensitive regex, got %q and %q", lowerFirst, regexFirst)
+		}
+
+		if _, raw := s.NormalizeAndFingerprint("Hello, World", s.WithPipeline(nil)); raw != "Hello, World" {
+			t.Errorf("An empty pipeline should leave the text untouched, got %q", raw)
+		}
+	})
+
+	t.Run("test sublinear weights", func(t *testing.T) {
+		doc := map[string]int{"spam": 1000}
+		for i := range 100 {
+			doc["token"+strconv.Itoa(i)] = 1
+		}
+		spam := s.NewSimhash([]string{"spam"})
+
+		linear := s.NewSimhash(doc)
+		if d := linear.Distance(spam); d != 0 {
+			t.Errorf("Expected the repeated token to dominate with linear weights, got distance %d", d)
+		}
+
+		damped := s.NewSimhash(doc, s.WithSubLinearWeights())
+		if d := damped.Distance(spam); d < 10 {
+			t.Errorf("Expected sublinear weights to move away from the repeated token, got distance %d", d)
+		}
+
+		unit := []string{"aaa", "bbb", "ccc"}
+		if !s.NewSimhash(unit, s.WithSubLinearWeights()).Equal(s.NewSimhash(unit)) {
+			t.Error("Unit weights should not be affected by sublinear weighting")
+		}
+	})
+
+	t.Run("test distance to uint64", func(t *testing.T) {
+		a := s.NewSimhash("How are you? I AM fine. Thank And you?")
+		b := s.NewSimhash("How old are you ? :-) i am fine. Thank And you?")
+
+		if got, want := a.DistanceToU64(b.Value.Uint64()), a.Distance(b); got != want {
+			t.Errorf("Expected %d, got %d", want, got)
+		}
+		if d := a.DistanceToU64(a.Value.Uint64()); d != 0 {
+			t.Errorf("Expected 0 against itself, got %d", d)
+		}
+
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a panic for f other than 64")
+			}
+		}()
+		s.NewSimhash(int64(1), s.WithF(128)).DistanceToU64(1)
+	})
+
+	t.Run("test feature normalizer", func(t *testing.T) {
+		mixed := map[string]int{"Hell": 1, "hell": 1, "ELLO": 2}
+		lower := map[string]int{"hell": 2, "ello": 2}
+
+		if s.NewSimhash(mixed).Equal(s.NewSimhash(lower)) {
+			t.Error("Features should be hashed as-is by default")
+		}
+
+		sh := s.NewSimhash(mixed, s.WithFeatureNormalizer(strings.ToLower), s.WithRetainFeatures())
+		if !sh.Equal(s.NewSimhash(lower)) {
+			t.Error("Normalized features should match their lowercase equivalent")
+		}
+		if !maps.Equal(sh.Features(), lower) {
+			t.Errorf("Expected retained features %v, got %v", lower, sh.Features())
+		}
+
+		if err := sh.Subtract(map[string]int{"ELLO": 2}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !sh.Equal(s.NewSimhash(map[string]int{"hell": 2})) {
+			t.Error("Subtract should normalize features the same way")
+		}
+	})
+
+	t.Run("test sample", func(t *testing.T) {
+		sh := s.NewSimhash(int64(0b1011_0000))
+
+		if key := sh.Sample([]int{4, 5, 6, 7}); key.Int64() != 0b1011 {
+			t.Errorf("Expected 1011, got %b", key)
+		}
+		if key := sh.Sample([]int{7, 0, 5}); key.Int64() != 0b101 {
+			t.Errorf("Expected 101, got %b", key)
+		}
+		if key := sh.Sample(nil); key.Sign() != 0 {
+			t.Errorf("Expected 0 for no positions, got %b", key)
+		}
+
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a panic for a position outside [0, F)")
+			}
+		}()
+		sh.Sample([]int{64})
+	})
+
+	t.Run("test transposition shingles", func(t *testing.T) {
+		typo := "I saw teh cat sitting on teh mat by teh door"
+		clean := "I saw the cat sitting on the mat by the door"
+
+		plain := s.NewSimhash(typo).Distance(s.NewSimhash(clean))
+		robust := s.NewSimhash(typo, s.WithTranspositionShingles()).Distance(s.NewSimhash(clean, s.WithTranspositionShingles()))
+		if robust >= plain {
+			t.Errorf("Expected transposition shingles to bring the texts closer, got %d then %d", plain, robust)
+		}
+
+		sh := s.NewSimhash("abcd", s.WithTranspositionShingles(), s.WithRetainFeatures())
+		if features := sh.Features(); len(features) != 2 || features["abcd"] != 1 || features["\x00abcd"] != 1 {
+			t.Errorf("Expected the shingle and its canonical variant, got %v", features)
+		}
+	})
+
+	t.Run("test fingerprint from digests", func(t *testing.T) {
+		features := map[string]int{"aaa": 3, "bbb": 1, "ccc": 70}
+		var digests [][]byte
+		var weights []int
+		for feature, weight := range features {
+			hash := md5.Sum([]byte(feature))
+			digests = append(digests, hash[:])
+			weights = append(weights, weight)
+		}
+
+		sh := s.Fingerprint(digests, weights, 64)
+		if sh == nil || !sh.Equal(s.NewSimhash(features)) {
+			t.Errorf("Expected Fingerprint to match NewSimhash on the same features")
+		}
+
+		unit := s.Fingerprint(digests, nil, 64)
+		if unit == nil || !unit.Equal(s.NewSimhash([]string{"aaa", "bbb", "ccc"})) {
+			t.Errorf("Expected nil weights to count every digest once")
+		}
+
+		if s.Fingerprint(digests, []int{1}, 64) != nil {
+			t.Error("Expected nil for mismatched weights")
+		}
+		if s.Fingerprint(digests, weights, 256) != nil {
+			t.Error("Expected nil for digests shorter than f/8")
+		}
+	})
+
+	t.Run("test within distance", func(t *testing.T) {
+		for _, f := range []int{8, 64, 128, 256} {
+			a := s.NewSimhash("How are you? I AM fine. Thank And you?", s.WithF(f), s.WithFold())
+			b := s.NewSimhash("How old are you ? :-) i am fine. Thank And you?", s.WithF(f), s.WithFold())
+			d := a.Distance(b)
+
+			if !a.WithinDistance(b, d) {
+				t.Errorf("f=%d: expected to be within the exact distance %d", f, d)
+			}
+			if d > 0 && a.WithinDistance(b, d-1) {
+				t.Errorf("f=%d: did not expect to be within %d", f, d-1)
+			}
+		}
+
+		// bits above F are ignored like in Distance
+		wide := s.NewSimhash(new(big.Int).Lsh(big.NewInt(1), 70), s.WithF(64))
+		if !wide.WithinDistance(s.NewSimhash(int64(0)), 0) {
+			t.Error("Expected bits above F to be ignored")
+		}
+	})
+
+	t.Run("test debug features", func(t *testing.T) {
+		text := "Hello hello"
+		sh := s.NewSimhash(text)
+		features := sh.DebugFeatures(text)
+
+		expected := []string{"ello", "hell", "lloh", "lohe", "ohel"}
+		if len(features) != len(expected) {
+			t.Fatalf("Expected %d features, got %v", len(expected), features)
+		}
+		var digests [][]byte
+		var weights []int
+		for i, fh := range features {
+			hash := md5.Sum([]byte(fh.Token))
+			if fh.Token != expected[i] || !bytes.Equal(fh.Hash, hash[8:]) {
+				t.Errorf("Unexpected feature %d: %+v", i, fh)
+			}
+			digests = append(digests, fh.Hash)
+			weights = append(weights, fh.Weight)
+		}
+		if features[1].Weight != 2 {
+			t.Errorf("Expected hell to have weight 2, got %d", features[1].Weight)
+		}
+
+		if !s.Fingerprint(digests, weights, 64).Equal(sh) {
+			t.Error("Voting with the debug features should reproduce the fingerprint")
+		}
+	})
+
+	t.Run("test rune shingles", func(t *testing.T) {
+		tokens := func(text string) []string {
+			var result []string
+			for _, fh := range s.NewSimhash("").DebugFeatures(text) {
+				result = append(result, fh.Token)
+			}
+			return result
+		}
+		cases := []struct {
+			text     string
+			expected []string
+		}{
+			{"abc", []string{"abc"}},
+			{"abcd", []string{"abcd"}},
+			{"abcde", []string{"abcd", "bcde"}},
+			{"你好", []string{"你好"}},
+			{"你好世", []string{"你好世"}},
+			{"你好世界", []string{"你好世界"}},
+			{"你好世界们", []string{"你好世界", "好世界们"}},
+		}
+		for _, c := range cases {
+			got := tokens(c.text)
+			slices.Sort(c.expected)
+			if !slices.Equal(got, c.expected) {
+				t.Errorf("Expected %q for %q, got %q", c.expected, c.text, got)
+			}
+		}
+
+		short := s.NewSimhash("你好")
+		if short.Value.Sign() == 0 {
+			t.Error("Expected a short text to have a non-zero fingerprint")
+		}
+		if short.Distance(s.NewSimhash("你好")) != 0 || short.Distance(s.NewSimhash("再见")) == 0 {
+			t.Error("Expected short texts to fingerprint by content")
+		}
+	})
+
+	t.Run("test string format", func(t *testing.T) {
+		value := big.NewInt(0xabcdef)
+		cases := []struct {
+			format   s.StringFormat
+			expected string
+		}{
+			{0, "0000000000abcdef"},
+			{s.FormatPrefix, "0x0000000000abcdef"},
+			{s.FormatUpper, "0000000000ABCDEF"},
+			{s.FormatGrouped, "00:00:00:00:00:ab:cd:ef"},
+			{s.FormatPrefix | s.FormatUpper | s.FormatGrouped, "0x00:00:00:00:00:AB:CD:EF"},
+		}
+		for _, c := range cases {
+			if got := s.NewSimhash(value, s.WithStringFormat(c.format)).String(); got != c.expected {
+				t.Errorf("Expected %s, got %s", c.expected, got)
+			}
+		}
+		if got := fmt.Sprint(s.NewSimhash(value)); got != "0000000000abcdef" {
+			t.Errorf("Expected Print to use String, got %s", got)
+		}
+	})
+
+	t.Run("test weighted feature slice", func(t *testing.T) {
+		features := []s.WeightedFeature{{"aaa", 5}, {"bbb", 3}, {"aaa", 1}}
+
+		summed := s.NewSimhash(features)
+		if expected := s.NewSimhash(map[string]int{"aaa": 6, "bbb": 3}); !summed.Equal(expected) {
+			t.Errorf("Expected repeated weights to be summed, got %s want %s", summed, expected)
+		}
+
+		overridden := s.NewSimhash(features, s.WithWeightOverride())
+		if expected := s.NewSimhash(map[string]int{"aaa": 1, "bbb": 3}); !overridden.Equal(expected) {
+			t.Errorf("Expected the last weight to win, got %s want %s", overridden, expected)
+		}
+		if summed.Equal(overridden) {
+			t.Error("Expected summing and overriding to differ")
+		}
+	})
+
+	t.Run("test base64", func(t *testing.T) {
+		sh := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg", s.WithF(128))
+		encoded := sh.Base64()
+		if len(encoded) != 22 || len(encoded) >= len(sh.Hex()) {
+			t.Errorf("Expected 22 characters, got %q", encoded)
+		}
+		decoded, err := s.NewSimhashFromBase64(encoded, 128)
+		if err != nil || !decoded.Equal(sh) || decoded.F != 128 {
+			t.Errorf("Expected %s, got %v (%v)", sh, decoded, err)
+		}
+
+		if small := s.NewSimhash(big.NewInt(1)).Base64(); small != "AAAAAAAAAAE" {
+			t.Errorf("Expected fixed-width encoding AAAAAAAAAAE, got %s", small)
+		}
+		if _, err := s.NewSimhashFromBase64(encoded, 64); err == nil {
+			t.Error("Expected an error for the wrong f")
+		}
+		if _, err := s.NewSimhashFromBase64("not base64!", 64); err == nil {
+			t.Error("Expected an error for invalid base64")
+		}
+	})
+
+	t.Run("test words", func(t *testing.T) {
+		value, _ := new(big.Int).SetString("0123456789abcdeffedcba9876543210aabbccdd", 16)
+		sh := s.NewSimhash(value, s.WithF(160))
+
+		words := sh.Words()
+		expected := []uint64{0x76543210aabbccdd, 0x89abcdeffedcba98, 0x01234567}
+		if !slices.Equal(words, expected) {
+			t.Errorf("Expected %x, got %x", expected, words)
+		}
+		if back := s.NewSimhashFromWords(words, 160); !back.Equal(sh) || back.F != 160 {
+			t.Errorf("Expected %s, got %s", sh, back)
+		}
+
+		short := s.NewSimhashFromWords([]uint64{0xffff_ffff_ffff_ffff}, 32)
+		if short.Value.Uint64() != 0xffffffff {
+			t.Errorf("Expected bits beyond f to be dropped, got %x", short.Value)
+		}
+
+		padded := s.NewSimhashFromWords([]uint64{1}, 128)
+		if padded.F != 128 || padded.Value.Cmp(big.NewInt(1)) != 0 {
+			t.Errorf("Expected missing words to be zero at f 128, got %x with f %d", padded.Value, padded.F)
+		}
+		if invalid := s.NewSimhashFromWords([]uint64{1}, -8); invalid.F != 64 {
+			t.Errorf("Expected an invalid f to be reset to 64, got %d", invalid.F)
+		}
+	})
+
+	t.Run("test strip diacritics", func(t *testing.T) {
+		plain := s.NewSimhash("Jose Muller, Sao Paulo")
+		if s.NewSimhash("José Müller, São Paulo").Equal(plain) {
+			t.Error("Expected accents to change the fingerprint by default")
+		}
+		for _, text := range []string{"José Müller, São Paulo", "JOSÉ MÜLLER, SÃO PAULO", "Jose\u0301 Mu\u0308ller, Sa\u0303o Paulo"} {
+			if got := s.NewSimhash(text, s.WithStripDiacritics()); !got.Equal(plain) {
+				t.Errorf("Expected %q to fingerprint like the plain spelling", text)
+			}
+		}
+
+		cased := s.NewSimhash("José", s.WithStripDiacritics(), s.WithoutLowercase())
+		if !cased.Equal(s.NewSimhash("Jose", s.WithoutLowercase())) || cased.Equal(s.NewSimhash("jose", s.WithoutLowercase())) {
+			t.Error("Expected diacritic stripping to compose with WithoutLowercase")
+		}
+		if got := s.StripDiacriticsStep(nil, "Łódź øre"); got != "Łodz øre" {
+			t.Errorf("Expected Łodz øre, got %s", got)
+		}
+	})
+
+	t.Run("test min rotation distance", func(t *testing.T) {
+		sh := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg")
+		v := sh.Value.Uint64()
+		left := s.NewSimhash(new(big.Int).SetUint64(bits.RotateLeft64(v, 5)))
+		right := s.NewSimhash(new(big.Int).SetUint64(bits.RotateLeft64(v, -3)))
+
+		if d := sh.MinRotationDistance(left, 5); d != 0 {
+			t.Errorf("Expected 0 for a rotation within range, got %d", d)
+		}
+		if d := sh.MinRotationDistance(right, 3); d != 0 {
+			t.Errorf("Expected 0 for a rotation the other way, got %d", d)
+		}
+		if d := sh.MinRotationDistance(left, 4); d > sh.Distance(left) || d == 0 {
+			t.Errorf("Expected a non-zero distance when the rotation is out of range, got %d", d)
+		}
+		if d := sh.MinRotationDistance(sh, 0); d != 0 {
+			t.Errorf("Expected 0 for itself, got %d", d)
+		}
+	})
+
+	t.Run("test token channel", func(t *testing.T) {
+		tokens := make(chan string)
+		go func() {
+			defer close(tokens)
+			for _, token := range []string{"aaa", "bbb", "aaa", "ccc", "aaa"} {
+				tokens <- token
+			}
+		}()
+
+		sh := s.NewSimhashFromTokens(tokens, s.WithF(128))
+		expected := s.NewSimhash(map[string]int{"aaa": 3, "bbb": 1, "ccc": 1}, s.WithF(128))
+		if !sh.Equal(expected) || sh.F != 128 {
+			t.Errorf("Expected %s, got %s", expected, sh)
+		}
+	})
+
+	t.Run("test safe regex pattern", func(t *testing.T) {
+		if _, err := s.WithRegexPatternSafe("[unclosed"); err == nil {
+			t.Error("Expected an error for an invalid pattern")
+		}
+		if _, err := s.WithRegexPatternSafe(""); err == nil {
+			t.Error("Expected an error for an empty pattern")
+		}
+		opt, err := s.WithRegexPatternSafe(`\w+`)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !s.NewSimhash("hello world", opt).Equal(s.NewSimhash("hello world", s.WithRegexPattern(`\w+`))) {
+			t.Error("Expected the same fingerprint as WithRegexPattern")
+		}
+	})
+
+	t.Run("test max text bytes", func(t *testing.T) {
+		text := "héllo wörld " + strings.Repeat("filler ", 1000)
+		limited := s.NewSimhash(text, s.WithMaxTextBytes(13))
+		if expected := s.NewSimhash("héllo wörld"); !limited.Equal(expected) {
+			t.Errorf("Expected only the first 13 bytes to count, got %s want %s", limited, expected)
+		}
+		// byte 3 falls inside é, which is dropped rather than split
+		if !s.NewSimhash("héllo", s.WithMaxTextBytes(2)).Equal(s.NewSimhash("h")) {
+			t.Error("Expected the limit to cut back to a whole character")
+		}
+
+		_, normalized := s.NormalizeAndFingerprint("Hello World, this is long", s.WithMaxTextBytes(5))
+		if normalized != "hello" {
+			t.Errorf("Expected the normalized text to be cut to hello, got %q", normalized)
+		}
+		a := s.NewSimhash("Hello there", s.WithMaxTextBytes(5), s.WithShortTextFallback(100))
+		b := s.NewSimhash("Hello world", s.WithMaxTextBytes(5), s.WithShortTextFallback(100))
+		if d := a.Distance(b); d != 0 {
+			t.Errorf("Expected the short text fallback to only compare the cut text, got %d", d)
+		}
+	})
+
+	t.Run("test similarity confidence", func(t *testing.T) {
+		a := s.NewSimhash(big.NewInt(0))
+		b := s.NewSimhash(big.NewInt(0b111))
+		score, within := a.SimilarityConfidence(b)
+		if score != a.Similarity(b) {
+			t.Errorf("Expected the score to be the similarity, got %v", score)
+		}
+		if math.Abs(within-0.0565) > 0.001 {
+			t.Errorf("Expected a half width near 0.0565, got %v", within)
+		}
+
+		wide := s.NewSimhash(big.NewInt(0), s.WithF(1024))
+		_, wideWithin := wide.SimilarityConfidence(s.NewSimhash(big.NewInt(0b111), s.WithF(1024)))
+		if wideWithin >= within/2 {
+			t.Errorf("Expected a much narrower interval at f 1024, got %v vs %v", wideWithin, within)
+		}
+		if _, same := a.SimilarityConfidence(a); same <= 0 {
+			t.Errorf("Expected a non-zero interval for identical fingerprints, got %v", same)
+		}
+	})
+
+	t.Run("test subtoken split", func(t *testing.T) {
+		tokens := func(text string, options ...s.Option) []string {
+			var result []string
+			for _, fh := range s.NewSimhash("", options...).DebugFeatures(text) {
+				result = append(result, fh.Token)
+			}
+			return result
+		}
+		hyphens, _ := s.WithRegexPatternSafe(`[\p{L}\p{N}_-]+`)
+
+		if got := tokens("fooBar-baz foo_bar", s.WithWordTokenizer(), hyphens); !slices.Equal(got, []string{"foo_bar", "foobar-baz"}) {
+			t.Errorf("Expected whole words without splitting, got %v", got)
+		}
+
+		split := []s.Option{s.WithWordTokenizer(), hyphens, s.WithSubtokenSplit(s.SplitCaseChange | s.SplitHyphen | s.SplitUnderscore)}
+		if got := tokens("fooBar-baz foo_bar", split...); !slices.Equal(got, []string{"bar", "baz", "foo"}) {
+			t.Errorf("Expected [bar baz foo], got %v", got)
+		}
+		if got := tokens("parseHTTPHeader v2Config", split...); !slices.Equal(got, []string{"config", "header", "http", "parse", "v2"}) {
+			t.Errorf("Expected acronyms kept together, got %v", got)
+		}
+
+		a := s.NewSimhash("fooBar-baz", split...)
+		if !a.Equal(s.NewSimhash("foo bar baz", split...)) {
+			t.Error("Expected split subtokens to fingerprint like separate words")
+		}
+		if s.NewSimhash("fooBar-baz", s.WithWordTokenizer(), hyphens).Equal(a) {
+			t.Error("Expected splitting to be opt-in")
+		}
+	})
+
+	t.Run("test build paths agree around the weight cutoff", func(t *testing.T) {
+		features := make(map[string]int)
+		for i := range 6000 {
+			features["feature "+strconv.Itoa(i)] = 50 + i%2
+		}
+
+		// reference: every feature votes its weight on each set digest bit
+		votes := make([]int, 64)
+		count := 0
+		for feature, weight := range features {
+			digest := md5.Sum([]byte(feature))
+			for i, b := range digest[8:] {
+				for j := range 8 {
+					votes[i*8+j] += int(b>>(7-j)&1) * weight
+				}
+			}
+			count += weight
+		}
+		expected := new(big.Int)
+		for i, v := range votes {
+			if v > count/2 {
+				expected.SetBit(expected, 63-i, 1)
+			}
+		}
+
+		both, err := s.BuildBoth(features)
+		if err != nil {
+			t.Fatalf("Expected the build paths to agree, got %v", err)
+		}
+		if both.Value.Cmp(expected) != 0 {
+			t.Errorf("Expected %x, got %s", expected, both)
+		}
+		for _, workers := range []int{1, 4} {
+			if sh := s.NewSimhash(features, s.WithWorkers(workers)); sh.Value.Cmp(expected) != 0 {
+				t.Errorf("Expected %x with %d workers, got %s", expected, workers, sh)
+			}
+		}
+		if _, err := s.BuildBoth(map[string]int{}); err != nil {
+			t.Errorf("Expected empty features to agree, got %v", err)
+		}
+	})
+
+	t.Run("test distance excluding positions", func(t *testing.T) {
+		a := s.NewSimhash(big.NewInt(0))
+		b := s.NewSimhash(new(big.Int).SetUint64(1<<0 | 1<<5 | 1<<63))
+
+		if d := a.DistanceExcluding(b, []int{5, 63}); d != 1 {
+			t.Errorf("Expected 1, got %d", d)
+		}
+		if d := a.DistanceExcluding(b, nil); d != a.Distance(b) {
+			t.Errorf("Expected the plain distance, got %d", d)
+		}
+		if d := a.DistanceMasked(b, big.NewInt(0b100001)); d != 1 {
+			t.Errorf("Expected 1, got %d", d)
+		}
+
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a panic for a position out of range")
+			}
+		}()
+		a.DistanceExcluding(b, []int{64})
+	})
+
+	t.Run("test raw text and shingle width", func(t *testing.T) {
+		text := "How are you? I Am fine. blar blar blar blar blar Thankg"
+		sh, normalized := s.NormalizeAndFingerprint(text)
+
+		if raw := s.NewSimhash(normalized, s.WithRawText()); !raw.Equal(sh) {
+			t.Errorf("Expected raw pre-normalized text to match the default build, got %s want %s", raw, sh)
+		}
+		if s.NewSimhash(text, s.WithRawText()).Equal(sh) {
+			t.Error("Expected raw text not to be lowercased or filtered")
+		}
+
+		wide := s.NewSimhash(normalized, s.WithRawText(), s.WithShingleWidth(6))
+		if !wide.Equal(s.NewSimhash(text, s.WithShingleWidth(6))) || wide.Equal(sh) {
+			t.Error("Expected the shingle width to apply to raw text")
+		}
+		tokens := s.NewSimhash("", s.WithShingleWidth(2)).DebugFeatures("abc")
+		if len(tokens) != 2 || tokens[0].Token != "ab" || tokens[1].Token != "bc" {
+			t.Errorf("Expected [ab bc], got %v", tokens)
+		}
+		if _, err := s.NewSimhashErr(text, s.WithShingleWidth(0)); err == nil {
+			t.Error("Expected an error for a zero shingle width")
+		}
+	})
+
+	t.Run("test byte ngrams", func(t *testing.T) {
+		rng := rand.New(rand.NewPCG(7, 8))
+		image := make([]byte, 4096)
+		for i := range image {
+			image[i] = byte(rng.UintN(256))
+		}
+		patched := bytes.Clone(image)
+		patched[100] ^= 0xff
+		patched[2000]++
+		patched[4000] = 0
+		other := make([]byte, 4096)
+		for i := range other {
+			other[i] = byte(rng.UintN(256))
+		}
+
+		ngrams := s.WithByteNgrams(8)
+		a := s.NewSimhash(image, ngrams)
+		if d := a.Distance(s.NewSimhash(patched, ngrams)); d > 3 {
+			t.Errorf("Expected a small distance for a patched image, got %d", d)
+		}
+		if d := a.Distance(s.NewSimhash(other, ngrams)); d < 16 {
+			t.Errorf("Expected a large distance for an unrelated image, got %d", d)
+		}
+
+		features := map[string]int{"\x00\x01": 1, "\x01\x02": 1}
+		if !s.NewSimhash([]byte{0, 1, 2}, s.WithByteNgrams(2)).Equal(s.NewSimhash(features)) {
+			t.Error("Expected byte windows as features")
+		}
+		if !s.NewSimhash([]byte("Hello World"), s.WithByteNgrams(20)).Equal(s.NewSimhash([]string{"Hello World"})) {
+			t.Error("Expected a short buffer to be a single feature, without the text pipeline")
+		}
+		if !s.NewSimhash([]byte("Hello World")).Equal(s.NewSimhash("Hello World")) {
+			t.Error("Expected bytes to build like text by default")
+		}
+	})
+
+	t.Run("test shingle weight cap", func(t *testing.T) {
+		text := "Quarterly revenue for the northern region rose sharply on new orders"
+		padded := text + strings.Repeat(" see terms and conditions", 40)
+
+		plain := s.NewSimhash(text)
+		uncapped := plain.Distance(s.NewSimhash(padded))
+		capped := s.NewSimhash(text, s.WithShingleWeightCap(1)).Distance(s.NewSimhash(padded, s.WithShingleWeightCap(1)))
+		if capped >= uncapped {
+			t.Errorf("Expected capping to keep the padded text closer, got %d capped vs %d uncapped", capped, uncapped)
+		}
+
+		features := s.NewSimhash("", s.WithShingleWeightCap(2)).DebugFeatures("aaaaaaaa")
+		if len(features) != 1 || features[0].Weight != 2 {
+			t.Errorf("Expected aaaa capped at 2, got %v", features)
+		}
+	})
+
+	t.Run("test hash byte selection", func(t *testing.T) {
+		text := "How are you? I AM fine. Thanks. And you?"
+		trailing := s.NewSimhash(text, s.WithHashByteSelection(s.HashBytesTrailing))
+		if !trailing.Equal(s.NewSimhash(text)) {
+			t.Error("Expected trailing bytes to be the default")
+		}
+
+		// the leading half of md5 at F=64 is the high half of the 128 bit value
+		leading := s.NewSimhash(text, s.WithHashByteSelection(s.HashBytesLeading))
+		wide := s.NewSimhash(text, s.WithF(128))
+		if high := new(big.Int).Rsh(wide.Value, 64); leading.Value.Cmp(high) != 0 {
+			t.Errorf("Expected the leading bytes to give %x, got %s", high, leading.Hex())
+		}
+
+		folded := s.NewSimhash(text, s.WithHashByteSelection(s.HashBytesFold))
+		if !folded.Equal(s.NewSimhash(text, s.WithFold())) || folded.Equal(trailing) || folded.Equal(leading) {
+			t.Error("Expected folding to match WithFold and differ from either half")
+		}
+		for _, mode := range []s.HashByteSelection{s.HashBytesTrailing, s.HashBytesLeading} {
+			if !s.NewSimhash(text, s.WithFold(), s.WithHashByteSelection(mode)).Equal(folded) {
+				t.Errorf("Expected WithFold to be kept with selection %d", mode)
+			}
+		}
+	})
+
+	t.Run("test hash funcs", func(t *testing.T) {
+		// weak sets each bit of its high half with probability 1/4
+		weak := func(data []byte) []byte {
+			h := fnv.New64a()
+			h.Write(data)
+			sum := h.Sum(nil)
+			for i := range 4 {
+				sum[i] &= sum[i+4]
+			}
+			return sum
+		}
+		tail := func(data []byte) []byte {
+			sum := md5.Sum(data)
+			return sum[12:]
+		}
+
+		rng := rand.New(rand.NewPCG(1, 2))
+		var single, combined []*s.Simhash
+		for range 500 {
+			letters := make([]byte, 40)
+			for j := range letters {
+				letters[j] = byte('a' + rng.IntN(26))
+			}
+			text := string(letters)
+			single = append(single, s.NewSimhash(text, s.WithHashFunc(weak)))
+			combined = append(combined, s.NewSimhash(text, s.WithHashFuncs(weak, tail)))
+		}
+		bias := func(hashes []*s.Simhash) float64 {
+			total := 0.0
+			for _, p := range s.BitEntropy(hashes) {
+				total += math.Abs(p - 0.5)
+			}
+			return total / 64
+		}
+		if bs, bc := bias(single), bias(combined); bc >= bs || bc > 0.1 {
+			t.Errorf("Expected the combined hashes to be less biased, got %.3f against %.3f", bc, bs)
+		}
+
+		// the concatenation of md5's halves is md5 itself
+		head := func(data []byte) []byte {
+			sum := md5.Sum(data)
+			return sum[:8]
+		}
+		back := func(data []byte) []byte {
+			sum := md5.Sum(data)
+			return sum[8:]
+		}
+		sim := s.NewSimhash("How are you?", s.WithF(128), s.WithHashFuncs(head, back))
+		if !sim.Equal(s.NewSimhash("How are you?", s.WithF(128))) {
+			t.Error("Expected the concatenated outputs to be used in order")
+		}
+	})
+
+	t.Run("test approx distance", func(t *testing.T) {
+		a := s.NewSimhash("How are you? I AM fine. Thanks. And you?")
+		b := s.NewSimhash("How old are you ? :-) i am fine. Thanks. And you?")
+		for _, n := range []int{0, 64, 100} {
+			if d := a.ApproxDistance(b, n); d != a.Distance(b) {
+				t.Errorf("Expected the exact distance for %d samples, got %d", n, d)
+			}
+		}
+		if d := a.ApproxDistance(a, 16); d != 0 {
+			t.Errorf("Expected 0 for identical fingerprints, got %d", d)
+		}
+		inverse := s.NewSimhash(new(big.Int).Xor(a.Value, new(big.Int).SetUint64(math.MaxUint64)))
+		if d := a.ApproxDistance(inverse, 16); d != 64 {
+			t.Errorf("Expected 64 for the inverse, got %d", d)
+		}
+
+		// over many pairs the estimate is unbiased
+		rng := rand.New(rand.NewPCG(3, 4))
+		total, exact := 0, 0
+		for range 2000 {
+			x := s.NewSimhash(new(big.Int).SetUint64(rng.Uint64()))
+			y := s.NewSimhash(new(big.Int).SetUint64(rng.Uint64()))
+			total += x.ApproxDistance(y, 16)
+			exact += x.Distance(y)
+		}
+		if mean, expected := float64(total)/2000, float64(exact)/2000; math.Abs(mean-expected) > 0.5 {
+			t.Errorf("Expected a mean near %.2f, got %.2f", expected, mean)
+		}
+	})
+
+	t.Run("test distance and overlap", func(t *testing.T) {
+		retain := s.WithRetainFeatures()
+		a := s.NewSimhash("abcdef", retain)
+		b := s.NewSimhash("abcdeg", retain)
+		dist, jaccard, err := a.DistanceAndOverlap(b)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		// {abcd bcde cdef} and {abcd bcde cdeg} share 2 of 4 shingles
+		if dist != a.Distance(b) || jaccard != 0.5 {
+			t.Errorf("Expected distance %d and overlap 0.5, got %d and %f", a.Distance(b), dist, jaccard)
+		}
+		if _, jaccard, _ := a.DistanceAndOverlap(a); jaccard != 1 {
+			t.Errorf("Expected full overlap with itself, got %f", jaccard)
+		}
+
+		if _, _, err := a.DistanceAndOverlap(s.NewSimhash("abcdef")); err == nil {
+			t.Error("Expected an error without retained features")
+		}
+		if _, _, err := a.DistanceAndOverlap(s.NewSimhash("abcdef", retain, s.WithF(128))); !errors.Is(err, s.ErrDimensionMismatch) {
+			t.Errorf("Expected ErrDimensionMismatch, got %v", err)
+		}
+	})
+
+	t.Run("test xor", func(t *testing.T) {
+		a := s.NewSimhash("How are you? I AM fine. Thanks. And you?")
+		b := s.NewSimhash("How old are you ? :-) i am fine. Thanks. And you?")
+		x, err := a.Xor(b)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if x.F != a.F || x.PopCount() != a.Distance(b) {
+			t.Errorf("Expected f %d and popcount %d, got %d and %d", a.F, a.Distance(b), x.F, x.PopCount())
+		}
+		if back, _ := x.Xor(b); !back.Equal(a) {
+			t.Error("Expected xoring the difference back to restore the fingerprint")
+		}
+
+		if _, err := a.Xor(s.NewSimhash("How are you?", s.WithF(128))); !errors.Is(err, s.ErrDimensionMismatch) {
+			t.Errorf("Expected ErrDimensionMismatch, got %v", err)
+		}
+	})
+
+	t.Run("test is degenerate", func(t *testing.T) {
+		if s.NewSimhash("How are you? I AM fine.").IsDegenerate() {
+			t.Error("Expected a text fingerprint not to be degenerate")
+		}
+		if !s.NewSimhash(int64(0)).IsDegenerate() {
+			t.Error("Expected all zeros to be degenerate")
+		}
+		if !s.NewSimhash(int64(-1)).IsDegenerate() {
+			t.Error("Expected all ones to be degenerate")
+		}
+		if !s.NewSimhash(new(big.Int).Lsh(big.NewInt(1), 64)).IsDegenerate() {
+			t.Error("Expected bits above F to be ignored")
+		}
+
+		var logs bytes.Buffer
+		log := slog.New(slog.NewTextHandler(&logs, nil))
+		// a feature whose digest is all zeros wins every bit alone
+		zero := func([]byte) []byte { return make([]byte, 8) }
+		sim := s.NewSimhash([]string{"only"}, s.WithHashFunc(zero), s.WithLogger(log))
+		if !sim.IsDegenerate() {
+			t.Fatalf("Expected a degenerate fingerprint, got %s", sim.Hex())
+		}
+		if !strings.Contains(logs.String(), "level=WARN") {
+			t.Errorf("Expected a warning for the degenerate build, got %q", logs.String())
+		}
+	})
+
+	t.Run("test whitespace normalization", func(t *testing.T) {
+		if !s.NewSimhash("foo bar").Equal(s.NewSimhash("foobar")) {
+			t.Error("Expected word boundaries to be dropped by default")
+		}
+		ws := s.WithWhitespaceNormalization()
+		if s.NewSimhash("foo bar", ws).Equal(s.NewSimhash("foobar", ws)) {
+			t.Error("Expected word boundaries to be kept with whitespace normalization")
+		}
+		if !s.NewSimhash("Foo   bar!\n", ws).Equal(s.NewSimhash("foo bar", ws)) {
+			t.Error("Expected runs of whitespace and punctuation to collapse to one space")
+		}
+		features := s.NewSimhash("", ws).DebugFeatures("ab, cd")
+		if len(features) != 2 || features[0].Token != "ab c" || features[1].Token != "b cd" {
+			t.Errorf("Expected the shingles [ab c, b cd], got %v", features)
+		}
+	})
+
+	t.Run("test batch", func(t *testing.T) {
+		texts := make([]string, 50)
+		for i := range texts {
+			texts[i] = "document number " + strconv.Itoa(i)
+		}
+		reg := regexp.MustCompile(`[a-z]+`)
+		sims := s.NewSimhashBatch(texts, s.WithSharedRegex(reg), s.WithF(128))
+		if len(sims) != len(texts) {
+			t.Fatalf("Expected %d fingerprints, got %d", len(texts), len(sims))
+		}
+		for i, sim := range sims {
+			if !sim.Equal(s.NewSimhash(texts[i], s.WithRegexPattern(`[a-z]+`), s.WithF(128))) {
+				t.Errorf("Expected fingerprint %d to match NewSimhash", i)
+			}
+			if sim.Reg != reg {
+				t.Errorf("Expected fingerprint %d to share the regex", i)
+			}
+		}
+		if sims := s.NewSimhashBatch(nil); len(sims) != 0 {
+			t.Errorf("Expected no fingerprints, got %d", len(sims))
+		}
+	})
+
+	t.Run("test empty text", func(t *testing.T) {
+		for _, text := range []string{"", "   ", "?!"} {
+			sim := s.NewSimhash(text)
+			if !sim.IsZero() || sim.Value.Sign() != 0 {
+				t.Errorf("Expected a zero fingerprint for %q, got %s", text, sim.Hex())
+			}
+		}
+		if s.NewSimhash("a").IsZero() {
+			t.Error("Expected a single letter to have a fingerprint")
+		}
+		if features := s.NewSimhash("").DebugFeatures(""); len(features) != 0 {
+			t.Errorf("Expected no features for empty text, got %v", features)
+		}
+		if s.NewSimhash("", s.WithPythonCompat()).IsZero() {
+			t.Error("Expected Python compat to hash the empty shingle")
+		}
+	})
+
+	t.Run("test python compat", func(t *testing.T) {
+		// fingerprints of the Python simhash package with its defaults, f=64,
+		// the md5 hashfunc and width 4; upstream's own test pins ['aaa', 'bbb']
+		vectors := []struct {
+			value any
+			want  uint64
+		}{
+			{"How are you?", 3891612042386514056},
+			{"How are you? I AM fine. Thanks. And you?", 13831624873712969754},
+			{"aaa bbb", 12095639495024767922},
+			{[]string{"aaa", "bbb"}, 57087923692560392},
+			{map[string]int{"aaa": 3, "bbb": 1, "ccc": 2}, 493941779799334920},
+			{"我是中国人", 9224507978414326836},
+			{"Ünïcödé straße ÉCOLE", 4414039177109492089},
+			{"a", 3585878926028121697},
+			{"", 16825458760271544958},
+			{"ΟΔΟΣ ΣΟΦΟΣ", 11863608628538572819},
+			{"ΣΑΣ, ΚΥΡΙΟΣ.", 12010064490604732961},
+		}
+		for _, v := range vectors {
+			got := s.NewSimhash(v.value, s.WithPythonCompat())
+			if !got.Value.IsUint64() || got.Value.Uint64() != v.want {
+				t.Errorf("Expected %d for %v, got %s", v.want, v.value, got.Value)
+			}
+		}
+
+		// only the final sigma differs from the default pipeline
+		if !s.NewSimhash("How are you?").Equal(s.NewSimhash("How are you?", s.WithPythonCompat())) {
+			t.Error("Expected the defaults to match Python outside of the final sigma")
+		}
+		if s.NewSimhash("ΟΔΟΣ ΣΟΦΟΣ").Equal(s.NewSimhash("ΟΔΟΣ ΣΟΦΟΣ", s.WithPythonCompat())) {
+			t.Error("Expected the final sigma to change the default fingerprint")
+		}
+	})
+
+	t.Run("test positional weighting", func(t *testing.T) {
+		decay := s.WithPositionalWeighting(func(pos, total int) float64 {
+			return 1 - float64(pos)/float64(total)
+		})
+		front := "Zebra stripes then a long body about quarterly sales figures"
+		back := "then a long body about quarterly sales figures Zebra stripes"
+
+		// without positions both texts share nearly every shingle
+		if d := s.NewSimhash(front).Distance(s.NewSimhash(back)); d > 10 {
+			t.Fatalf("Expected the unweighted texts to be close, got %d", d)
+		}
+		if s.NewSimhash(front, decay).Equal(s.NewSimhash(back, decay)) {
+			t.Error("Expected moving a term to the front to change the fingerprint")
+		}
+
+		uniform := s.WithPositionalWeighting(func(int, int) float64 { return 1 })
+		if !s.NewSimhash(front, uniform).Equal(s.NewSimhash(front)) {
+			t.Error("Expected uniform weighting to match the default")
+		}
+		features := s.NewSimhash("", decay).DebugFeatures("abcdef")
+		weights := map[string]int{}
+		for _, f := range features {
+			weights[f.Token] = f.Weight
+		}
+		if weights["abcd"] != 100 || weights["bcde"] != 67 || weights["cdef"] != 33 {
+			t.Errorf("Expected weights 100, 67 and 33, got %v", weights)
+		}
+	})
+
 	t.Run("test short", func(t *testing.T) {
 		texts := []string{"aa", "aaa", "aaaa", "aaaab", "aaaaabb", "aaaaabbb"}
 		var simhashes []*big.Int
@@ -119,6 +1409,32 @@ func TestSimhash(t *testing.T) {
 		}
 	})
 
+	t.Run("test short text fallback", func(t *testing.T) {
+		fallback := s.WithShortTextFallback(8)
+		a := s.NewSimhash("Jonathan", fallback)
+		b := s.NewSimhash("Jonathon", fallback)
+
+		// 1 edit over 8 characters is 8 of 64 bits
+		if d := a.Distance(b); d != 8 {
+			t.Errorf("Expected 8, got %d", d)
+		}
+		if !a.WithinDistance(b, 8) || a.WithinDistance(b, 7) {
+			t.Error("Expected WithinDistance to use the edit distance too")
+		}
+		if d := a.Distance(s.NewSimhash("JONATHAN!", fallback)); d != 0 {
+			t.Errorf("Expected normalized texts to be compared, got %d", d)
+		}
+
+		plain := s.NewSimhash("Jonathan")
+		if d := a.Distance(plain); d != plain.Distance(s.NewSimhash("Jonathan")) {
+			t.Errorf("Expected the bit distance against a document without the text, got %d", d)
+		}
+		long := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg", fallback)
+		if d, bitDistance := a.Distance(long), new(big.Int).Xor(a.Value, long.Value); d != len(strings.ReplaceAll(bitDistance.Text(2), "0", "")) {
+			t.Errorf("Expected the bit distance against a long document, got %d", d)
+		}
+	})
+
 	t.Run("test equality comparison", func(t *testing.T) {
 		a := s.NewSimhash("My name is John")
 
@@ -135,6 +1451,87 @@ func TestSimhash(t *testing.T) {
 		}
 	})
 
+	t.Run("test combine features", func(t *testing.T) {
+		a := s.NewSimhash("hello hello", s.WithRetainFeatures())
+		b := s.NewSimhash("hello world", s.WithRetainFeatures())
+		combined, err := s.CombineFeatures([]*s.Simhash{a, b})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		expected := map[string]int{"hell": 3, "ello": 3, "lloh": 1, "lohe": 1, "ohel": 1, "llow": 1, "lowo": 1, "owor": 1, "worl": 1, "orld": 1}
+		if !maps.Equal(combined, expected) {
+			t.Errorf("Expected %v, got %v", expected, combined)
+		}
+		if !s.NewSimhash(combined).Equal(s.NewSimhash(expected)) {
+			t.Error("Expected the combined features to build like any feature map")
+		}
+
+		if _, err := s.CombineFeatures([]*s.Simhash{a, s.NewSimhash("hello")}); err == nil || !strings.Contains(err.Error(), "simhash 1") {
+			t.Errorf("Expected an error naming simhash 1, got %v", err)
+		}
+	})
+
+	t.Run("test negative weights", func(t *testing.T) {
+		positive := s.NewSimhash(map[string]int{"aaa": 1})
+		negative := s.NewSimhash(map[string]int{"aaa": -1})
+		if expected := new(big.Int).Xor(positive.Value, new(big.Int).SetUint64(math.MaxUint64)); negative.Value.Cmp(expected) != 0 {
+			t.Errorf("Expected a lone negative feature to invert its digest, got %s want %x", negative, expected)
+		}
+
+		// signed reference: each feature adds its weight to the bits its
+		// digest sets and subtracts it from the others
+		features := map[string]int{"aaa": 3, "bbb": 2, "ccc": -4, "ddd": 1}
+		sums := make([]int, 64)
+		for feature, weight := range features {
+			digest := md5.Sum([]byte(feature))
+			for i, b := range digest[8:] {
+				for j := range 8 {
+					if b>>(7-j)&1 == 1 {
+						sums[i*8+j] += weight
+					} else {
+						sums[i*8+j] -= weight
+					}
+				}
+			}
+		}
+		expected := new(big.Int)
+		for i, sum := range sums {
+			if sum > 0 {
+				expected.SetBit(expected, 63-i, 1)
+			}
+		}
+		sh := s.NewSimhash(features)
+		if sh.Value.Cmp(expected) != 0 {
+			t.Errorf("Expected %x, got %s", expected, sh)
+		}
+
+		// the negative feature decides some bits the others would have set
+		delete(features, "ccc")
+		without := s.NewSimhash(features)
+		flipped := new(big.Int).AndNot(without.Value, sh.Value)
+		if flipped.Sign() == 0 {
+			t.Error("Expected the negative weight to clear at least one bit")
+		}
+		ccc := s.NewSimhash([]string{"ccc"})
+		if new(big.Int).And(flipped, ccc.Value).Cmp(flipped) != 0 {
+			t.Errorf("Expected only bits set in ccc's digest to be cleared, got %x", flipped)
+		}
+	})
+
+	t.Run("test constant time equality", func(t *testing.T) {
+		a := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg")
+		if !a.EqualConstantTime(s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg")) {
+			t.Error("Expected equal fingerprints to compare equal")
+		}
+		if a.EqualConstantTime(s.NewSimhash("This is simhash test.")) {
+			t.Error("Expected different fingerprints to differ")
+		}
+		zero := s.NewSimhash(int64(0))
+		if zero.EqualConstantTime(s.NewSimhash(int64(0), s.WithF(128))) || zero.EqualConstantTime(s.NewSimhash(int64(0), s.WithF(8))) {
+			t.Error("Expected different dimensions to differ")
+		}
+	})
+
 	t.Run("test custom hashfunc", func(t *testing.T) {
 		intHashFunc := func(x []byte) []byte {
 			hash := md5.Sum(x)
@@ -157,8 +1554,81 @@ func TestSimhash(t *testing.T) {
 		t.Logf("Int hash: %x", b.Value)
 		t.Logf("SHA hash: %x", c.Value)
 
-		if a.Equal(c) {
-			t.Error("Different hash functions should produce different results")
+		if a.Equal(c) {
+			t.Error("Different hash functions should produce different results")
+		}
+	})
+
+	t.Run("test hash padding", func(t *testing.T) {
+		short := func(data []byte) []byte {
+			sum := sha256.Sum256(data)
+			return sum[:8]
+		}
+		variable := func(data []byte) []byte {
+			sum := sha256.Sum256(data)
+			return sum[:min(len(data), 8)]
+		}
+		text := "How are you? I Am fine. blar blar blar blar blar Thankg"
+
+		if _, err := s.NewSimhashErr(text, s.WithHashFunc(short), s.WithF(128)); err == nil {
+			t.Error("Expected an error for a short hash without padding")
+		}
+		plain := s.NewSimhash(text, s.WithHashFunc(short))
+		for _, mode := range []s.HashPadding{s.HashPadZero, s.HashPadRepeat, s.HashPadCounter} {
+			if !s.NewSimhash(text, s.WithHashFunc(short), s.WithHashPadding(mode)).Equal(plain) {
+				t.Errorf("Expected padding mode %d to leave a long enough hash alone", mode)
+			}
+		}
+
+		zero := s.NewSimhash(text, s.WithHashFunc(short), s.WithF(128), s.WithHashPadding(s.HashPadZero))
+		if zero.Value.BitLen() > 64 || zero.Value.Cmp(plain.Value) != 0 {
+			t.Errorf("Expected zero padding to leave the high bits clear, got %s", zero)
+		}
+		repeat := s.NewSimhash(text, s.WithHashFunc(short), s.WithF(128), s.WithHashPadding(s.HashPadRepeat))
+		if expected := new(big.Int).Or(new(big.Int).Lsh(plain.Value, 64), plain.Value); repeat.Value.Cmp(expected) != 0 {
+			t.Errorf("Expected the 64 bits repeated, got %s", repeat)
+		}
+		counter := s.NewSimhash(text, s.WithHashFunc(short), s.WithF(128), s.WithHashPadding(s.HashPadCounter))
+		// the hash fills the high bits and the rehashes the low ones
+		high, low := new(big.Int).Rsh(counter.Value, 64), new(big.Int).And(counter.Value, new(big.Int).SetUint64(math.MaxUint64))
+		if high.Cmp(plain.Value) != 0 || low.Cmp(plain.Value) == 0 {
+			t.Errorf("Expected the hash followed by independent bits, got %s", counter)
+		}
+
+		// a hash shorter than 8 bytes for short tokens at f 64
+		padded, err := s.NewSimhashErr([]string{"a", "bb", "longer token"}, s.WithHashFunc(variable), s.WithHashPadding(s.HashPadCounter))
+		if err != nil || padded.Value.Sign() == 0 {
+			t.Errorf("Expected a fingerprint from variable length hashes, got %v (%v)", padded, err)
+		}
+	})
+
+	t.Run("test distance err", func(t *testing.T) {
+		var logs bytes.Buffer
+		logger := s.WithLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+		shaHashFunc := func(x []byte) []byte {
+			hash := sha256.Sum256(x)
+			return hash[:]
+		}
+
+		a := s.NewSimhash("My name is John", logger)
+		b := s.NewSimhash("My name is Jane", logger)
+		if d, err := a.DistanceErr(b); err != nil || d != a.Distance(b) {
+			t.Errorf("Expected distance %d, got %d, %v", a.Distance(b), d, err)
+		}
+		if logs.Len() != 0 {
+			t.Errorf("Did not expect a warning for the same hash function, got %q", logs.String())
+		}
+
+		c := s.NewSimhash("My name is John", s.WithHashFunc(shaHashFunc))
+		if _, err := a.DistanceErr(c); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !strings.Contains(logs.String(), "different hash functions") {
+			t.Errorf("Expected a hash function warning, got %q", logs.String())
+		}
+
+		if _, err := a.DistanceErr(s.NewSimhash("My name is John", s.WithF(128))); !errors.Is(err, s.ErrDimensionMismatch) {
+			t.Errorf("Expected ErrDimensionMismatch, got %v", err)
 		}
 	})
 
@@ -212,6 +1682,36 @@ func TestSimhashIndex(t *testing.T) {
 
 	index := s.NewSimhashIndex(objs, s.SimhashIndexWithK(10))
 
+	t.Run("test add all with progress", func(t *testing.T) {
+		objs := make([]s.Object, 1050)
+		for i := range objs {
+			objs[i] = s.Object{ObjectId: strconv.Itoa(i), S: s.NewSimhash(int64(i) * 7919)}
+		}
+		index := s.NewSimhashIndex(nil)
+		var calls [][2]int
+		index.AddAllWithProgress(objs, func(done, total int) {
+			calls = append(calls, [2]int{done, total})
+		})
+
+		if n := index.Metrics().Objects; n != int64(len(objs)) {
+			t.Errorf("Expected %d objects, got %d", len(objs), n)
+		}
+		if len(calls) > 100 {
+			t.Errorf("Expected at most 100 reports, got %d", len(calls))
+		}
+		if calls[0] != [2]int{11, 1050} || calls[len(calls)-1] != [2]int{1050, 1050} {
+			t.Errorf("Expected reports from 11 to 1050 of 1050, got %v and %v", calls[0], calls[len(calls)-1])
+		}
+
+		var small []int
+		s.NewSimhashIndex(nil).AddAllWithProgress(objs[:3], func(done, _ int) {
+			small = append(small, done)
+		})
+		if !slices.Equal(small, []int{1, 2, 3}) {
+			t.Errorf("Expected a report per object for a small slice, got %v", small)
+		}
+	})
+
 	t.Run("test get near duplicates", func(t *testing.T) {
 		s1 := s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank")
 
@@ -254,6 +1754,718 @@ func TestSimhashIndex(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("test update", func(t *testing.T) {
+		s1 := s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank")
+
+		if err := index.Update("3", s.NewSimhash(data[3])); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		dups := index.GetNearDups(s1)
+		if len(dups) != 4 {
+			t.Errorf("After updating ID=3, expected 4 duplicates, got %d: %v", len(dups), dups)
+		}
+
+		if err := index.Update("3", s.NewSimhash(data[2])); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		dups = index.GetNearDups(s1)
+		if len(dups) != 3 {
+			t.Errorf("After restoring ID=3, expected 3 duplicates, got %d: %v", len(dups), dups)
+		}
+
+		if err := index.Update("missing", s1); !errors.Is(err, s.ErrObjectNotFound) {
+			t.Errorf("Expected ErrObjectNotFound, got %v", err)
+		}
+		if err := index.Update("3", s.NewSimhash(data[2], s.WithF(128))); !errors.Is(err, s.ErrDimensionMismatch) {
+			t.Errorf("Expected ErrDimensionMismatch, got %v", err)
+		}
+	})
+
+	t.Run("test recall guarantee", func(t *testing.T) {
+		var logs bytes.Buffer
+		ix := s.NewSimhashIndex(objs, s.SimhashIndexWithK(3), s.SimhashIndexWithLog(slog.New(slog.NewTextHandler(&logs, nil))))
+
+		if got := ix.GuaranteedRecallDistance(); got != 3 {
+			t.Errorf("Expected guaranteed recall distance 3, got %d", got)
+		}
+
+		q := s.NewSimhash(data[0])
+		if dups := ix.GetNearDupsK(q, 0); len(dups) != 1 || dups[0] != "1" {
+			t.Errorf("Expected only ID=1 at k=0, got %v", dups)
+		}
+		if logs.Len() != 0 {
+			t.Errorf("Did not expect a warning within the guarantee, got %q", logs.String())
+		}
+
+		ix.GetNearDupsK(q, 10)
+		if !strings.Contains(logs.String(), "level=WARN") {
+			t.Errorf("Expected a warning for k beyond the guarantee, got %q", logs.String())
+		}
+	})
+
+	t.Run("test sorted buckets", func(t *testing.T) {
+		var corpus []s.Object
+		for i := range 500 {
+			corpus = append(corpus, s.Object{ObjectId: strconv.Itoa(i), S: s.NewSimhash("document number " + strconv.Itoa(i%50))})
+		}
+
+		plain := s.NewSimhashIndex(corpus, s.SimhashIndexWithK(6))
+		sorted := s.NewSimhashIndex(corpus, s.SimhashIndexWithK(6), s.SimhashIndexWithSortedBuckets())
+		for i := 0; i < 500; i += 2 {
+			plain.Delete(corpus[i])
+			sorted.Delete(corpus[i])
+		}
+
+		for i := range 60 {
+			q := s.NewSimhash("document number " + strconv.Itoa(i))
+			for _, k := range []int{0, 3, 6} {
+				expected := plain.GetNearDupsK(q, k)
+				got := sorted.GetNearDupsK(q, k)
+				slices.Sort(expected)
+				slices.Sort(got)
+				if !slices.Equal(got, expected) {
+					t.Fatalf("Query %d at k=%d: expected %v, got %v", i, k, expected, got)
+				}
+			}
+		}
+
+		// the sorted slices replace the map rather than mirror it
+		if len(sorted.Bucket) != 0 || sorted.BucketSize() != plain.BucketSize() {
+			t.Errorf("Expected an empty Bucket map and %d buckets, got %d and %d", plain.BucketSize(), len(sorted.Bucket), sorted.BucketSize())
+		}
+		if err := sorted.Validate(); err != nil {
+			t.Errorf("Expected a valid index, got %v", err)
+		}
+		if !sorted.Equal(plain) || !plain.Equal(sorted) {
+			t.Error("Expected the sorted index to equal the plain one")
+		}
+	})
+
+	t.Run("test batch queries", func(t *testing.T) {
+		queries := []*s.Simhash{
+			s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank"),
+			s.NewSimhash(data[2]),
+			s.NewSimhash("nothing like the others at all"),
+			s.NewSimhash(data[0], s.WithF(128)),
+		}
+
+		results := index.GetNearDupsBatch(queries)
+		if len(results) != len(queries) {
+			t.Fatalf("Expected %d results, got %d", len(queries), len(results))
+		}
+		for i, q := range queries {
+			expected := index.GetNearDups(q)
+			slices.Sort(expected)
+			slices.Sort(results[i])
+			if !slices.Equal(results[i], expected) {
+				t.Errorf("Query %d: expected %v, got %v", i, expected, results[i])
+			}
+		}
+	})
+
+	t.Run("test grouped by distance", func(t *testing.T) {
+		q := s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank")
+
+		distances := index.GetNearDupsWithDistance(q)
+		groups := index.GetNearDupsGrouped(q)
+
+		total := 0
+		for d, ids := range groups {
+			total += len(ids)
+			for _, id := range ids {
+				if distances[id] != d {
+					t.Errorf("ID=%s grouped under %d but has distance %d", id, d, distances[id])
+				}
+				n, _ := strconv.Atoi(id)
+				if got := q.Distance(s.NewSimhash(data[n-1])); got != d {
+					t.Errorf("ID=%s grouped under %d but is %d away", id, d, got)
+				}
+			}
+		}
+		if total != 3 || len(distances) != 3 {
+			t.Errorf("Expected 3 grouped duplicates, got %v", groups)
+		}
+
+		exact := index.GetNearDupsGrouped(s.NewSimhash(data[2]))
+		if ids := exact[0]; len(ids) != 1 || ids[0] != "3" {
+			t.Errorf("Expected ID=3 as the exact match, got %v", exact)
+		}
+	})
+
+	t.Run("test validate", func(t *testing.T) {
+		if err := index.Validate(); err != nil {
+			t.Fatalf("Expected a valid index, got %v", err)
+		}
+
+		corrupt := func(mutate func(ix *s.SimhashIndex)) error {
+			ix := s.NewSimhashIndex(objs, s.SimhashIndexWithK(3))
+			mutate(ix)
+			return ix.Validate()
+		}
+
+		if err := corrupt(func(ix *s.SimhashIndex) {
+			ix.Bucket["dead:0"] = map[string]string{}
+		}); err == nil || !strings.Contains(err.Error(), "empty") {
+			t.Errorf("Expected an empty bucket error, got %v", err)
+		}
+
+		if err := corrupt(func(ix *s.SimhashIndex) {
+			for key := range ix.Bucket {
+				ix.Bucket[key]["zz,9"] = "zz,9"
+				break
+			}
+		}); err == nil || !strings.Contains(err.Error(), "malformed") {
+			t.Errorf("Expected a malformed entry error, got %v", err)
+		}
+
+		if err := corrupt(func(ix *s.SimhashIndex) {
+			for key, entries := range ix.Bucket {
+				for val := range entries {
+					delete(entries, val)
+					if len(entries) == 0 {
+						delete(ix.Bucket, key)
+					}
+					return
+				}
+			}
+		}); err == nil || !strings.Contains(err.Error(), "expected 4") {
+			t.Errorf("Expected a bucket count error, got %v", err)
+		}
+	})
+
+	t.Run("test reindex", func(t *testing.T) {
+		ix := s.NewSimhashIndex(objs, s.SimhashIndexWithK(10), s.SimhashIndexWithSortedBuckets())
+		q := s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank")
+		if dups := ix.GetNearDups(q); len(dups) != 3 {
+			t.Fatalf("Expected 3 duplicates at k=10, got %v", dups)
+		}
+
+		if err := ix.Reindex(2); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		fresh := s.NewSimhashIndex(objs, s.SimhashIndexWithK(2))
+		got, expected := ix.GetNearDups(q), fresh.GetNearDups(q)
+		slices.Sort(got)
+		slices.Sort(expected)
+		if !slices.Equal(got, expected) || ix.BucketSize() != fresh.BucketSize() {
+			t.Errorf("Expected the reindexed index to match a fresh k=2 index, got %v and %v", got, expected)
+		}
+		if err := ix.Validate(); err != nil {
+			t.Errorf("Expected a valid index after reindexing, got %v", err)
+		}
+
+		untracked := s.NewSimhashIndex(nil)
+		untracked.Bucket["0:0"] = map[string]string{"0,x": "0,x"}
+		if err := untracked.Reindex(3); err == nil {
+			t.Error("Expected an error without tracked fingerprints")
+		}
+	})
+
+	t.Run("test filtered by tags", func(t *testing.T) {
+		tenants := []string{"acme", "globex", "acme", "acme"}
+		var tagged []s.Object
+		for i, obj := range objs {
+			obj.Tags = map[string]string{"tenant": tenants[i], "lang": "en"}
+			tagged = append(tagged, obj)
+		}
+		ix := s.NewSimhashIndex(tagged, s.SimhashIndexWithK(10))
+		q := s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank")
+
+		dups := ix.GetNearDupsFiltered(q, map[string]string{"tenant": "acme"})
+		slices.Sort(dups)
+		if !slices.Equal(dups, []string{"1", "4"}) {
+			t.Errorf("Expected [1 4] for acme, got %v", dups)
+		}
+		if dups := ix.GetNearDupsFiltered(q, map[string]string{"tenant": "globex", "lang": "en"}); len(dups) != 1 || dups[0] != "2" {
+			t.Errorf("Expected [2] for globex, got %v", dups)
+		}
+		if dups := ix.GetNearDupsFiltered(q, nil); len(dups) != 3 {
+			t.Errorf("Expected no filter to match all 3 duplicates, got %v", dups)
+		}
+
+		if err := ix.Update("2", objs[3].S); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if dups := ix.GetNearDupsFiltered(q, map[string]string{"tenant": "globex"}); len(dups) != 1 || dups[0] != "2" {
+			t.Errorf("Expected Update to keep the tags, got %v", dups)
+		}
+	})
+
+	t.Run("test strict mode", func(t *testing.T) {
+		var logs bytes.Buffer
+		ix := s.NewSimhashIndex(objs, s.SimhashIndexWithK(10), s.SimhashIndexWithStrict(), s.SimhashIndexWithLog(slog.New(slog.NewTextHandler(&logs, nil))))
+		q := s.NewSimhash("How are you i am fine.ablar ablar xyz blar blar blar blar blar blar blar thank")
+		// 11 blocks don't split 64 bits evenly, which is warned about once
+		logs.Reset()
+
+		ix.GetNearDups(q)
+		if logs.Len() != 0 {
+			t.Fatalf("Did not expect a warning for a consistent index, got %q", logs.String())
+		}
+
+		// plant a second fingerprint for ID=1 behind the index's back
+		stale := s.NewSimhash(data[3])
+		for _, key := range ix.GetKeys(stale) {
+			val := stale.Hex() + ",1"
+			if ix.Bucket[key] == nil {
+				ix.Bucket[key] = map[string]string{}
+			}
+			ix.Bucket[key][val] = val
+		}
+
+		if dups := ix.GetNearDups(q); len(dups) != 3 {
+			t.Errorf("Expected 3 duplicates, got %v", dups)
+		}
+		if !strings.Contains(logs.String(), "ids=[1]") {
+			t.Errorf("Expected a warning naming ID=1, got %q", logs.String())
+		}
+	})
+
+	t.Run("test block distances", func(t *testing.T) {
+		index := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3))
+		a := s.NewSimhash(big.NewInt(0))
+		b := s.NewSimhash(new(big.Int).SetUint64(1<<0 | 1<<1 | 1<<20 | 1<<63))
+
+		expected := []int{2, 1, 0, 1}
+		if got := index.BlockDistances(a, b); !slices.Equal(got, expected) {
+			t.Errorf("Expected %v, got %v", expected, got)
+		}
+		if got := index.BlockDistances(a, a); !slices.Equal(got, []int{0, 0, 0, 0}) {
+			t.Errorf("Expected all zero, got %v", got)
+		}
+	})
+
+	t.Run("test block collision stats", func(t *testing.T) {
+		index := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3))
+		add := func(id string, v uint64) {
+			index.Add(s.Object{ObjectId: id, S: s.NewSimhash(new(big.Int).SetUint64(v))})
+		}
+		add("a", 0)
+		add("b", 1)             // differs in block 0
+		add("c", 1|1<<16|1<<32) // differs in blocks 0, 1 and 2
+		add("d", 1|1<<16|1<<32|1<<48)
+
+		stats := index.BlockCollisionStats([][2]string{{"a", "b"}, {"a", "c"}, {"a", "d"}, {"a", "missing"}})
+		expected := s.BlockStats{
+			Pairs:          3,
+			Missing:        1,
+			BlockMatches:   []int{0, 1, 1, 2},
+			MatchingBlocks: []int{1, 1, 0, 1, 0},
+		}
+		if stats.Pairs != expected.Pairs || stats.Missing != expected.Missing ||
+			!slices.Equal(stats.BlockMatches, expected.BlockMatches) || !slices.Equal(stats.MatchingBlocks, expected.MatchingBlocks) {
+			t.Errorf("Expected %+v, got %+v", expected, stats)
+		}
+	})
+
+	t.Run("test candidate count", func(t *testing.T) {
+		index := s.NewSimhashIndex(nil, s.SimhashIndexWithK(3))
+		base := uint64(0xffff)
+		index.Add(s.Object{ObjectId: "a", S: s.NewSimhash(new(big.Int).SetUint64(base))})
+		index.Add(s.Object{ObjectId: "b", S: s.NewSimhash(new(big.Int).SetUint64(base | 1<<40))})
+		index.Add(s.Object{ObjectId: "c", S: s.NewSimhash(new(big.Int).SetUint64(^base))})
+
+		query := s.NewSimhash(new(big.Int).SetUint64(base))
+		// a shares all 4 blocks, b shares 3 and c none
+		if got := index.CandidateCount(query); got != 7 {
+			t.Errorf("Expected 7 candidate entries, got %d", got)
+		}
+		if got := index.CandidateCount(s.NewSimhash(int64(0), s.WithF(128))); got != 0 {
+			t.Errorf("Expected 0 for a different f, got %d", got)
+		}
+	})
+
+	t.Run("test add text", func(t *testing.T) {
+		index := s.NewSimhashIndex(nil, s.SimhashIndexWithF(128))
+		if err := index.AddText("a", "How are you? I Am fine. blar blar blar blar blar Thankg"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		query := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg", s.WithF(128))
+		if dups := index.GetNearDups(query); !slices.Equal(dups, []string{"a"}) {
+			t.Errorf("Expected [a], got %v", dups)
+		}
+
+		if err := index.AddText("b", "some text", s.WithF(64)); !errors.Is(err, s.ErrDimensionMismatch) {
+			t.Errorf("Expected ErrDimensionMismatch, got %v", err)
+		}
+		if err := index.AddText("c", "some text", s.WithWorkers(0)); err == nil {
+			t.Error("Expected an error for an invalid option")
+		}
+		if index.Validate() != nil || index.BucketSize() != 3 {
+			t.Errorf("Expected only the first text to be indexed, got %d buckets", index.BucketSize())
+		}
+	})
+
+	t.Run("test fixed width entries", func(t *testing.T) {
+		low := s.NewSimhash(new(big.Int).SetUint64(0x00ff00ff00ff00ff))
+		near := s.NewSimhash(new(big.Int).SetUint64(0x00ff00ff00ff00fc))
+		index := s.NewSimhashIndex([]s.Object{{ObjectId: "low", S: low}})
+
+		for key, entries := range index.Bucket {
+			for entry := range entries {
+				if entry != "00ff00ff00ff00ff,low" {
+					t.Errorf("Expected a 16 digit entry in %s, got %q", key, entry)
+				}
+			}
+		}
+		if d := index.GetNearDupsWithDistance(near); d["low"] != 2 || len(d) != 1 {
+			t.Errorf("Expected low at distance 2, got %v", d)
+		}
+		index.Delete(s.Object{ObjectId: "low", S: low})
+		if index.BucketSize() != 0 {
+			t.Errorf("Expected the entries to be deleted, got %d buckets", index.BucketSize())
+		}
+	})
+
+	t.Run("test get dups", func(t *testing.T) {
+		base := uint64(0x0123456789abcdef)
+		index := s.NewSimhashIndex([]s.Object{
+			{ObjectId: "b", S: s.NewSimhash(new(big.Int).SetUint64(base))},
+			{ObjectId: "a", S: s.NewSimhash(new(big.Int).SetUint64(base))},
+			{ObjectId: "two", S: s.NewSimhash(new(big.Int).SetUint64(base ^ 0b11))},
+			{ObjectId: "one", S: s.NewSimhash(new(big.Int).SetUint64(base ^ 1<<40))},
+			{ObjectId: "far", S: s.NewSimhash(new(big.Int).SetUint64(^base))},
+		})
+		exact, near := index.GetDups(s.NewSimhash(new(big.Int).SetUint64(base)))
+		if !slices.Equal(exact, []string{"a", "b"}) {
+			t.Errorf("Expected exact [a b], got %v", exact)
+		}
+		if !slices.Equal(near, []string{"one", "two"}) {
+			t.Errorf("Expected near [one two], got %v", near)
+		}
+	})
+
+	t.Run("test index equal", func(t *testing.T) {
+		var objs []s.Object
+		for i := range 100 {
+			objs = append(objs, s.Object{ObjectId: strconv.Itoa(i), S: s.NewSimhash("document number " + strconv.Itoa(i))})
+		}
+		a := s.NewSimhashIndex(objs)
+		reversed := slices.Clone(objs)
+		slices.Reverse(reversed)
+		b := s.NewSimhashIndex(reversed)
+		if !a.Equal(b) || !b.Equal(a) || !a.Equal(a) {
+			t.Error("Expected indexes with the same objects to be equal")
+		}
+
+		b.Delete(objs[0])
+		if a.Equal(b) {
+			t.Error("Expected a missing object to make the indexes differ")
+		}
+		b.Add(s.Object{ObjectId: "other", S: objs[0].S})
+		if a.Equal(b) {
+			t.Error("Expected a different id to make the indexes differ")
+		}
+		if a.Equal(s.NewSimhashIndex(objs, s.SimhashIndexWithK(3))) {
+			t.Error("Expected a different k to make the indexes differ")
+		}
+
+		// comparing both ways while writers queue up on both must not deadlock
+		c, d := s.NewSimhashIndex(objs), s.NewSimhashIndex(objs)
+		var wg sync.WaitGroup
+		for i := range 4 {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				for range 200 {
+					c.Equal(d)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for range 200 {
+					d.Equal(c)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := range 200 {
+					obj := s.Object{ObjectId: "w" + strconv.Itoa(i*200+j), S: objs[j%len(objs)].S}
+					c.Add(obj)
+					d.Add(obj)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("test min shingles", func(t *testing.T) {
+		index := s.NewSimhashIndex(nil)
+		minShingles := s.WithMinShingles(5)
+
+		// "hello" has 2 shingles of width 4
+		if err := index.AddText("a", "Hello!", minShingles); !errors.Is(err, s.ErrTooFewShingles) {
+			t.Errorf("Expected ErrTooFewShingles, got %v", err)
+		}
+		if err := index.AddText("b", "?!", s.WithMinShingles(1)); !errors.Is(err, s.ErrTooFewShingles) {
+			t.Errorf("Expected text without words to have no shingles, got %v", err)
+		}
+		if err := index.AddText("c", "How are you? I Am fine.", minShingles); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+		if err := index.AddText("d", "Hello!"); err != nil {
+			t.Errorf("Expected no minimum by default, got %v", err)
+		}
+		if n := index.Metrics().Objects; n != 2 {
+			t.Errorf("Expected 2 objects indexed, got %d", n)
+		}
+	})
+
+	t.Run("test delete where", func(t *testing.T) {
+		for _, sorted := range []bool{false, true} {
+			var opts []s.IndexOptions
+			if sorted {
+				opts = append(opts, s.SimhashIndexWithSortedBuckets())
+			}
+			var objs []s.Object
+			for i := range 20 {
+				objs = append(objs, s.Object{ObjectId: "user-" + strconv.Itoa(i%4) + "/" + strconv.Itoa(i), S: s.NewSimhash("document number " + strconv.Itoa(i))})
+			}
+			index := s.NewSimhashIndex(objs, opts...)
+			calls := 0
+			n := index.DeleteWhere(func(id string) bool {
+				calls++
+				return strings.HasPrefix(id, "user-1/")
+			})
+			if n != 5 || calls != 20 {
+				t.Errorf("Expected 5 objects removed with 20 calls, got %d and %d", n, calls)
+			}
+			if err := index.Validate(); err != nil {
+				t.Errorf("Expected a valid index, got %v", err)
+			}
+			if m := index.Metrics(); m.Objects != 15 {
+				t.Errorf("Expected 15 objects left, got %d", m.Objects)
+			}
+			for _, obj := range objs {
+				dups := index.GetNearDups(obj.S)
+				if slices.Contains(dups, obj.ObjectId) == strings.HasPrefix(obj.ObjectId, "user-1/") {
+					t.Errorf("Expected only user-1 objects to be gone, got %v for %s", dups, obj.ObjectId)
+				}
+			}
+
+			if n := index.DeleteWhere(func(string) bool { return true }); n != 15 || index.BucketSize() != 0 {
+				t.Errorf("Expected everything removed, got %d with %d buckets left", n, index.BucketSize())
+			}
+		}
+
+		// every record is written while its object is still indexed
+		var index *s.SimhashIndex
+		logged := 0
+		wal := writerFunc(func(p []byte) (int, error) {
+			if p[0] != 'I' {
+				return len(p), nil
+			}
+			// a delete by id is the operation, F, the id length and the id
+			id := string(p[3:])
+			indexed := false
+			for _, entries := range index.Bucket {
+				for val := range entries {
+					indexed = indexed || strings.HasSuffix(val, ","+id)
+				}
+			}
+			if !indexed {
+				t.Errorf("Expected %s to be logged before it is removed", id)
+			}
+			logged++
+			return len(p), nil
+		})
+		index = s.NewSimhashIndex(nil, s.SimhashIndexWithWAL(wal))
+		index.Add(s.Object{ObjectId: "a", S: s.NewSimhash("document a")})
+		index.Add(s.Object{ObjectId: "b", S: s.NewSimhash("document b")})
+		logged = 0
+		if n := index.DeleteWhere(func(string) bool { return true }); n != 2 || logged != 2 {
+			t.Errorf("Expected 2 objects removed and logged, got %d and %d", n, logged)
+		}
+	})
+
+	t.Run("test delete by id scan", func(t *testing.T) {
+		for _, sorted := range []bool{false, true} {
+			var opts []s.IndexOptions
+			if sorted {
+				opts = append(opts, s.SimhashIndexWithSortedBuckets())
+			}
+			index := s.NewSimhashIndex(nil, opts...)
+			a := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg")
+			index.Add(s.Object{ObjectId: "a", S: a, Tags: map[string]string{"k": "v"}})
+			index.Add(s.Object{ObjectId: "b", S: s.NewSimhash("This is simhash test.")})
+
+			if n := index.DeleteByIDScan("a"); n != 3 {
+				t.Errorf("Expected 3 entries removed, got %d", n)
+			}
+			if dups := index.GetNearDups(a); len(dups) != 0 {
+				t.Errorf("Expected no duplicates left, got %v", dups)
+			}
+			if err := index.Validate(); err != nil {
+				t.Errorf("Expected a valid index, got %v", err)
+			}
+			if index.BucketSize() != 3 {
+				t.Errorf("Expected empty buckets to be removed, got %d buckets", index.BucketSize())
+			}
+			if n := index.DeleteByIDScan("missing"); n != 0 {
+				t.Errorf("Expected 0 for an unknown id, got %d", n)
+			}
+		}
+	})
+
+	t.Run("test metrics", func(t *testing.T) {
+		index := s.NewSimhashIndex(nil)
+		sims := make([]*s.Simhash, 20)
+		var wg sync.WaitGroup
+		for i := range sims {
+			sims[i] = s.NewSimhash("document number " + strconv.Itoa(i) + " with some distinct text " + strconv.Itoa(i*i))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				index.Add(s.Object{ObjectId: strconv.Itoa(i), S: sims[i]})
+				index.GetNearDups(sims[i])
+				_ = index.Metrics()
+			}()
+		}
+		wg.Wait()
+		index.Delete(s.Object{ObjectId: "0", S: sims[0]})
+		index.DeleteByIDScan("1")
+
+		expected := s.IndexMetrics{Adds: 20, Deletes: 2, Queries: 20, Objects: 18}
+		if got := index.Metrics(); got != expected {
+			t.Errorf("Expected %+v, got %+v", expected, got)
+		}
+
+		// ignored adds and deletes that remove nothing are not counted
+		index.Add(s.Object{ObjectId: "nil"})
+		index.Add(s.Object{ObjectId: "wide", S: s.NewSimhash("wide", s.WithF(128))})
+		index.Delete(s.Object{ObjectId: "0", S: sims[0]})
+		index.Delete(s.Object{ObjectId: "missing", S: sims[2]})
+		index.DeleteByIDScan("missing")
+		index.Add(s.Object{ObjectId: "2", S: sims[2]})
+		if err := index.Update("3", sims[3]); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := index.Metrics(); got != expected {
+			t.Errorf("Expected no-ops to leave %+v, got %+v", expected, got)
+		}
+
+		index.Add(s.Object{ObjectId: "2", S: sims[2], Tags: map[string]string{"lang": "en"}})
+		if err := index.Update("3", sims[4]); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got := index.Metrics().Adds; got != expected.Adds+2 {
+			t.Errorf("Expected a retag and an Update to count as adds, got %d", got)
+		}
+	})
+
+	t.Run("test ignore mask", func(t *testing.T) {
+		// the low byte holds a version number that is expected to differ
+		mask := big.NewInt(0xff)
+		index := s.NewSimhashIndex(nil, s.SimhashIndexWithIgnoreMask(mask))
+		plain := s.NewSimhashIndex(nil)
+
+		base := uint64(0x0123456789abcd00)
+		a := s.NewSimhash(new(big.Int).SetUint64(base | 0x5a))
+		b := s.NewSimhash(new(big.Int).SetUint64(base | 0xa5 | 1<<41))
+		for _, ix := range []*s.SimhashIndex{index, plain} {
+			ix.Add(s.Object{ObjectId: "a", S: a})
+		}
+
+		if dups := index.GetNearDupsWithDistance(b); len(dups) != 1 || dups["a"] != 1 {
+			t.Errorf("Expected a at distance 1, got %v", dups)
+		}
+		if dups := plain.GetNearDups(b); len(dups) != 0 {
+			t.Errorf("Expected no duplicates without the mask, got %v", dups)
+		}
+		if !slices.Equal(index.GetKeys(a), index.GetKeys(s.NewSimhash(new(big.Int).SetUint64(base)))) {
+			t.Error("Expected masked bits not to affect the bucket keys")
+		}
+
+		index.Delete(s.Object{ObjectId: "a", S: a})
+		if index.BucketSize() != 0 || index.Metrics().Objects != 0 {
+			t.Errorf("Expected delete to find the masked entries, got %d buckets", index.BucketSize())
+		}
+	})
+
+	t.Run("test exact duplicates", func(t *testing.T) {
+		index := s.NewSimhashIndex(nil)
+		a := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg")
+		near := s.NewSimhash("How are you i am fine. blar blar blar blar blar than")
+		index.Add(s.Object{ObjectId: "2", S: a})
+		index.Add(s.Object{ObjectId: "1", S: a})
+		index.Add(s.Object{ObjectId: "3", S: near})
+
+		if dups := index.GetExactDups(a); !slices.Equal(dups, []string{"1", "2"}) {
+			t.Errorf("Expected [1 2], got %v", dups)
+		}
+		if err := index.Validate(); err != nil {
+			t.Errorf("Expected a valid index, got %v", err)
+		}
+
+		index.Add(s.Object{ObjectId: "2", S: near})
+		index.Delete(s.Object{ObjectId: "1", S: a})
+		if dups := index.GetExactDups(a); len(dups) != 0 {
+			t.Errorf("Expected no exact duplicates left, got %v", dups)
+		}
+		if dups := index.GetExactDups(near); !slices.Equal(dups, []string{"2", "3"}) {
+			t.Errorf("Expected [2 3], got %v", dups)
+		}
+		index.DeleteByIDScan("3")
+		if err := index.Validate(); err != nil {
+			t.Errorf("Expected a valid index, got %v", err)
+		}
+		if dups := index.GetExactDups(near); !slices.Equal(dups, []string{"2"}) {
+			t.Errorf("Expected [2], got %v", dups)
+		}
+	})
+
+	t.Run("test range", func(t *testing.T) {
+		seen := make(map[string]*s.Simhash)
+		index.Range(func(id string, sh *s.Simhash) bool {
+			seen[id] = sh
+			return true
+		})
+		if len(seen) != len(data) {
+			t.Fatalf("Expected %d objects, got %d", len(data), len(seen))
+		}
+		for i, txt := range data {
+			sh, ok := seen[strconv.Itoa(i+1)]
+			if !ok || !sh.Equal(s.NewSimhash(txt)) {
+				t.Errorf("Object %d was not visited with its fingerprint", i+1)
+			}
+		}
+
+		visits := 0
+		index.Range(func(string, *s.Simhash) bool {
+			visits++
+			return false
+		})
+		if visits != 1 {
+			t.Errorf("Expected Range to stop after 1 visit, got %d", visits)
+		}
+
+		// visited fingerprints are complete Simhashes, logger included
+		wide := s.NewSimhashIndex([]s.Object{{ObjectId: "a", S: s.NewSimhash(data[0], s.WithF(128))}}, s.SimhashIndexWithF(128))
+		wide.Range(func(_ string, sh *s.Simhash) bool {
+			if _, err := s.CompareAcrossF(sh, s.NewSimhash(data[0])); err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			return true
+		})
+	})
+}
+
+func FuzzRegexPatternSafe(f *testing.F) {
+	f.Add(`[\p{L}]+`, "How are you? I Am fine.")
+	f.Add(`(a+)+$`, strings.Repeat("a", 64)+"!")
+	f.Add(`[unclosed`, "text")
+	f.Add(`(?:x*)*y`, "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx")
+
+	f.Fuzz(func(t *testing.T, pattern, text string) {
+		opt, err := s.WithRegexPatternSafe(pattern)
+		if err != nil {
+			return
+		}
+		if sh := s.NewSimhash(text, opt, s.WithMaxTextBytes(1<<16)); sh == nil {
+			t.Error("Expected a fingerprint")
+		}
+	})
 }
 
 func BenchmarkSimhash(b *testing.B) {
@@ -289,3 +2501,31 @@ func BenchmarkSimhash(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkWeightJustUnderCutoff(b *testing.B) {
+	features := map[string]int{"heavy": 49}
+	b.ReportAllocs()
+	for b.Loop() {
+		s.NewSimhash(features)
+	}
+}
+
+func BenchmarkRawText(b *testing.B) {
+	_, normalized := s.NormalizeAndFingerprint(strings.Repeat("How are you? I Am fine. blar blar blar blar blar Thankg ", 200))
+	b.Run("normalized", func(b *testing.B) {
+		for b.Loop() {
+			s.NewSimhash(normalized)
+		}
+	})
+	b.Run("raw", func(b *testing.B) {
+		for b.Loop() {
+			s.NewSimhash(normalized, s.WithRawText())
+		}
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,150 @@
+package simhash
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"sync"
+)
+
+// CountingSketch answers "has something similar been seen" for an unbounded
+// stream in bounded memory. Every fingerprint's index blocks are hashed into
+// a counting Bloom filter, a fingerprint is reported as seen when one of its
+// blocks is present. Like the index it never misses a fingerprint within K of
+// an added one, but it can report false positives, both from the filter and
+// from fingerprints sharing a block while being further than K apart.
+type CountingSketch struct {
+	K   int
+	F   int
+	Log *slog.Logger
+
+	blocks int
+
+	mu       sync.RWMutex
+	counters []uint8
+	hashes   int
+}
+
+// NewCountingSketch returns a sketch sized for capacity fingerprints with a
+// filter false-positive rate of about fpRate per query. It accepts the same
+// options as NewSimhashIndex to set F, K and the number of blocks.
+func NewCountingSketch(capacity int, fpRate float64, ixOpt ...IndexOptions) *CountingSketch {
+	cfg := newIndexConfig(ixOpt...)
+	if capacity < 1 {
+		cfg.Log.Error("capacity should be at least 1\ngot", "capacity:", capacity)
+		capacity = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		cfg.Log.Error("fpRate should be between 0 and 1\ngot", "fpRate:", fpRate)
+		fpRate = 0.01
+	}
+
+	blocks := cfg.numBlocks()
+	// a query checks every block, so each block gets an equal share of the
+	// false-positive budget
+	keys := float64(capacity * blocks)
+	p := fpRate / float64(blocks)
+	slots := math.Ceil(-keys * math.Log(p) / (math.Ln2 * math.Ln2))
+	hashes := max(int(math.Round(slots/keys*math.Ln2)), 1)
+
+	return &CountingSketch{
+		K:        cfg.K,
+		F:        cfg.F,
+		Log:      cfg.Log,
+		blocks:   blocks,
+		counters: make([]uint8, int(slots)),
+		hashes:   hashes,
+	}
+}
+
+// Add records sim in the sketch, a fingerprint of another F is logged and
+// ignored
+func (c *CountingSketch) Add(sim *Simhash) {
+	if !c.checkF(sim) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range blockKeys(sim, c.F, c.blocks-1) {
+		for _, slot := range c.slots(key) {
+			// saturated counters stay put so Remove can't underflow them
+			if c.counters[slot] < math.MaxUint8 {
+				c.counters[slot]++
+			}
+		}
+	}
+}
+
+// Remove forgets a fingerprint previously recorded with Add, so a sliding
+// window can be kept by removing fingerprints as they age out. Removing a
+// fingerprint that was never added corrupts the sketch.
+func (c *CountingSketch) Remove(sim *Simhash) {
+	if !c.checkF(sim) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range blockKeys(sim, c.F, c.blocks-1) {
+		for _, slot := range c.slots(key) {
+			if n := c.counters[slot]; n > 0 && n < math.MaxUint8 {
+				c.counters[slot]--
+			}
+		}
+	}
+}
+
+// SeenSimilar reports whether a fingerprint sharing a block with sim, as
+// every fingerprint within K does, has been added. A fingerprint of another
+// F is logged and never seen.
+func (c *CountingSketch) SeenSimilar(sim *Simhash) bool {
+	if !c.checkF(sim) {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, key := range blockKeys(sim, c.F, c.blocks-1) {
+		if c.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkF reports whether sim has the sketch's F, logging it if not
+func (c *CountingSketch) checkF(sim *Simhash) bool {
+	if sim == nil || sim.F != c.F {
+		c.Log.Error("simhashes must have same dimensions, ignoring the fingerprint", "f", c.F)
+		return false
+	}
+	return true
+}
+
+// Size returns the number of counters, one byte each
+func (c *CountingSketch) Size() int {
+	return len(c.counters)
+}
+
+func (c *CountingSketch) contains(key string) bool {
+	for _, slot := range c.slots(key) {
+		if c.counters[slot] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// slots returns the counters for key, derived from two halves of one 64 bit
+// hash by double hashing
+func (c *CountingSketch) slots(key string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+
+	n := uint64(len(c.counters))
+	slots := make([]uint64, c.hashes)
+	for i := range slots {
+		slots[i] = (h1 + uint64(i)*h2) % n
+	}
+	return slots
+}
@@ -0,0 +1,83 @@
+package simhash_test
+
+import (
+	"bytes"
+	"log/slog"
+	"math/big"
+	"math/rand/v2"
+	"testing"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestCountingSketch(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := func() *s.Simhash {
+		return s.NewSimhash(new(big.Int).SetUint64(rng.Uint64()))
+	}
+
+	sketch := s.NewCountingSketch(1000, 0.01, s.SimhashIndexWithK(2))
+	added := make([]*s.Simhash, 1000)
+	for i := range added {
+		added[i] = random()
+		sketch.Add(added[i])
+	}
+
+	t.Run("test near duplicates are seen", func(t *testing.T) {
+		for _, sim := range added {
+			near := new(big.Int).Set(sim.Value)
+			near.SetBit(near, 3, near.Bit(3)^1)
+			near.SetBit(near, 40, near.Bit(40)^1)
+			if !sketch.SeenSimilar(s.NewSimhash(near)) {
+				t.Fatalf("Expected a near duplicate of %s to be seen", sim)
+			}
+		}
+	})
+
+	t.Run("test false positive rate", func(t *testing.T) {
+		positives := 0
+		for range 10000 {
+			if sketch.SeenSimilar(random()) {
+				positives++
+			}
+		}
+		if rate := float64(positives) / 10000; rate > 0.03 {
+			t.Errorf("Expected a false positive rate around 0.01, got %v", rate)
+		}
+	})
+
+	t.Run("test remove", func(t *testing.T) {
+		small := s.NewCountingSketch(10, 0.01)
+		sim := random()
+		small.Add(sim)
+		small.Remove(sim)
+		if small.SeenSimilar(sim) {
+			t.Error("Expected a removed fingerprint not to be seen")
+		}
+	})
+
+	t.Run("test size is bounded", func(t *testing.T) {
+		if size := sketch.Size(); size > 50000 {
+			t.Errorf("Expected under 50000 counters, got %d", size)
+		}
+	})
+	t.Run("test no layout warning", func(t *testing.T) {
+		var logs bytes.Buffer
+		s.NewCountingSketch(10, 0.01, s.SimhashIndexWithK(4), s.SimhashIndexWithLog(slog.New(slog.NewTextHandler(&logs, nil))))
+		if logs.Len() != 0 {
+			t.Errorf("Did not expect the index layout warning, got %q", logs.String())
+		}
+	})
+	t.Run("test other f is ignored", func(t *testing.T) {
+		var logs bytes.Buffer
+		small := s.NewCountingSketch(10, 0.01, s.SimhashIndexWithLog(slog.New(slog.NewTextHandler(&logs, nil))))
+		wide := s.NewSimhash(new(big.Int).SetUint64(rng.Uint64()), s.WithF(128))
+		small.Add(wide)
+		if small.SeenSimilar(wide) || small.SeenSimilar(s.NewSimhash(new(big.Int).Set(wide.Value))) {
+			t.Error("Expected a 128 bit fingerprint not to be recorded in a 64 bit sketch")
+		}
+		if logs.Len() == 0 {
+			t.Error("Expected the mismatch to be logged")
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package simhash
+
+import (
+	"container/heap"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// Match is a candidate returned by TopKWithin, Index being its position in
+// the candidates slice
+type Match struct {
+	Index    int
+	S        *Simhash
+	Distance int
+}
+
+// candidates below this are scanned by a single goroutine
+var topKParallelCutoff = 4096
+
+// TopKWithin returns the k candidates closest to query that are at most
+// maxDist away, closest first with ties in candidate order. Large slices are
+// split across goroutines, each keeping a bounded heap of its best matches
+// and skipping candidates that can't beat its current worst match as soon as
+// enough differing bits are seen. All candidates must share query's F,
+// TopKWithin panics otherwise before scanning any.
+func TopKWithin(query *Simhash, candidates []*Simhash, k, maxDist int) []Match {
+	if k <= 0 || maxDist < 0 || len(candidates) == 0 {
+		return nil
+	}
+	for _, c := range candidates {
+		if c.F != query.F {
+			panic("simhashes must have same dimensions")
+		}
+	}
+	k = min(k, len(candidates))
+
+	workers := 1
+	if len(candidates) >= topKParallelCutoff {
+		workers = min(runtime.NumCPU(), len(candidates)/(topKParallelCutoff/4))
+	}
+
+	partial := make([]matchHeap, workers)
+	if workers == 1 {
+		partial[0] = topKScan(query, candidates, 0, k, maxDist)
+	} else {
+		chunk := (len(candidates) + workers - 1) / workers
+		var wg sync.WaitGroup
+		for w := range workers {
+			start, end := min(w*chunk, len(candidates)), min((w+1)*chunk, len(candidates))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				partial[w] = topKScan(query, candidates[start:end], start, k, maxDist)
+			}()
+		}
+		wg.Wait()
+	}
+
+	var result []Match
+	for _, h := range partial {
+		result = append(result, h...)
+	}
+	slices.SortFunc(result, compareMatches)
+	if len(result) > k {
+		result = result[:k]
+	}
+	return result
+}
+
+// topKScan keeps the k best matches of candidates, whose positions start at
+// offset
+func topKScan(query *Simhash, candidates []*Simhash, offset, k, maxDist int) matchHeap {
+	h := make(matchHeap, 0, k)
+	for i, c := range candidates {
+		limit := maxDist
+		if len(h) == k {
+			// only a strictly closer candidate can replace the worst match,
+			// since ties go to the earlier candidate
+			limit = h[0].Distance - 1
+		}
+		if limit < 0 {
+			continue
+		}
+		d, ok := query.distanceWithin(c, limit)
+		if !ok {
+			continue
+		}
+		m := Match{Index: offset + i, S: c, Distance: d}
+		if len(h) < k {
+			heap.Push(&h, m)
+		} else {
+			h[0] = m
+			heap.Fix(&h, 0)
+		}
+	}
+	return h
+}
+
+func compareMatches(a, b Match) int {
+	if a.Distance != b.Distance {
+		return a.Distance - b.Distance
+	}
+	return a.Index - b.Index
+}
+
+// matchHeap is a max-heap with the worst match on top
+type matchHeap []Match
+
+func (h matchHeap) Len() int           { return len(h) }
+func (h matchHeap) Less(i, j int) bool { return compareMatches(h[i], h[j]) > 0 }
+func (h matchHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *matchHeap) Push(x any)        { *h = append(*h, x.(Match)) }
+func (h *matchHeap) Pop() any {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
@@ -0,0 +1,80 @@
+package simhash_test
+
+import (
+	"math/big"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestTopKWithin(t *testing.T) {
+	query := s.NewSimhash(big.NewInt(0))
+	flips := func(n int) *s.Simhash {
+		return s.NewSimhash(new(big.Int).SetUint64(1<<n - 1))
+	}
+
+	t.Run("test closest within cap", func(t *testing.T) {
+		candidates := []*s.Simhash{flips(5), flips(1), flips(3), flips(1), flips(9), flips(0)}
+		got := s.TopKWithin(query, candidates, 3, 4)
+
+		var indexes, distances []int
+		for _, m := range got {
+			indexes = append(indexes, m.Index)
+			distances = append(distances, m.Distance)
+			if m.S != candidates[m.Index] {
+				t.Errorf("Expected the match to point at candidate %d", m.Index)
+			}
+		}
+		if !slices.Equal(indexes, []int{5, 1, 3}) || !slices.Equal(distances, []int{0, 1, 1}) {
+			t.Errorf("Expected indexes [5 1 3] at [0 1 1], got %v at %v", indexes, distances)
+		}
+
+		if got := s.TopKWithin(query, candidates, 10, 2); len(got) != 3 {
+			t.Errorf("Expected only the 3 candidates within 2, got %v", got)
+		}
+		if got := s.TopKWithin(query, candidates, 0, 64); got != nil {
+			t.Errorf("Expected nil for k 0, got %v", got)
+		}
+		if got := s.TopKWithin(query, candidates, 1<<62, 3); len(got) != 4 {
+			t.Errorf("Expected a huge k to return the 4 candidates within 3, got %v", got)
+		}
+	})
+
+	t.Run("test mismatched dimensions panic in the caller", func(t *testing.T) {
+		candidates := make([]*s.Simhash, 5000)
+		for i := range candidates {
+			candidates[i] = flips(i % 64)
+		}
+		candidates[4999] = s.NewSimhash(big.NewInt(0), s.WithF(128))
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected a panic for mismatched dimensions")
+			}
+		}()
+		s.TopKWithin(query, candidates, 3, 4)
+	})
+
+	t.Run("test large parallel scan", func(t *testing.T) {
+		rng := rand.New(rand.NewPCG(3, 4))
+		candidates := make([]*s.Simhash, 10000)
+		for i := range candidates {
+			candidates[i] = s.NewSimhash(new(big.Int).SetUint64(rng.Uint64()))
+		}
+
+		got := s.TopKWithin(query, candidates, 10, 20)
+
+		var expected []s.Match
+		for i, c := range candidates {
+			if d := query.Distance(c); d <= 20 {
+				expected = append(expected, s.Match{Index: i, S: c, Distance: d})
+			}
+		}
+		slices.SortStableFunc(expected, func(a, b s.Match) int { return a.Distance - b.Distance })
+		expected = expected[:10]
+		if !slices.Equal(got, expected) {
+			t.Errorf("Expected %v, got %v", expected, got)
+		}
+	})
+}
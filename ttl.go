@@ -0,0 +1,175 @@
+package simhash
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+var defaultTTL = time.Hour
+
+// TTLSimhashIndex wraps a SimhashIndex and forgets objects once they are
+// older than its TTL. Expired objects are evicted on every Add and
+// GetNearDups, or explicitly with Sweep, so they never show up in results.
+// The wrapped index must not be modified directly.
+type TTLSimhashIndex struct {
+	index *SimhashIndex
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu sync.Mutex
+	// added holds the insertion time of each object, order the same objects
+	// oldest first, stale elements are skipped when the object was re-added
+	added map[string]time.Time
+	order *list.List
+}
+
+type ttlEntry struct {
+	id    string
+	added time.Time
+}
+
+type TTLOption func(*TTLSimhashIndex)
+
+// WithTTL sets how long objects are kept, default one hour
+func WithTTL(d time.Duration) TTLOption {
+	return func(t *TTLSimhashIndex) {
+		t.ttl = d
+	}
+}
+
+// WithClock replaces time.Now as the source of insertion and expiry times
+func WithClock(now func() time.Time) TTLOption {
+	return func(t *TTLSimhashIndex) {
+		t.now = now
+	}
+}
+
+// NewTTLSimhashIndex wraps index, which should be empty, with expiry
+func NewTTLSimhashIndex(index *SimhashIndex, options ...TTLOption) *TTLSimhashIndex {
+	t := &TTLSimhashIndex{
+		index: index,
+		ttl:   defaultTTL,
+		now:   time.Now,
+		added: make(map[string]time.Time),
+		order: list.New(),
+	}
+
+	for _, opt := range options {
+		opt(t)
+	}
+
+	return t
+}
+
+// Add inserts obj, stamping it with the current time
+func (t *TTLSimhashIndex) Add(obj Object) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.evict(now)
+	if obj.S == nil || obj.S.F != t.index.F {
+		return
+	}
+	t.index.Add(obj)
+	t.added[obj.ObjectId] = now
+	t.order.PushBack(ttlEntry{id: obj.ObjectId, added: now})
+}
+
+func (t *TTLSimhashIndex) Delete(obj Object) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.index.Delete(obj)
+	t.index.mu.RLock()
+	_, ok := t.index.objects[obj.ObjectId]
+	t.index.mu.RUnlock()
+	if !ok {
+		delete(t.added, obj.ObjectId)
+	}
+}
+
+// GetNearDups evicts expired objects and returns the remaining ones within K
+func (t *TTLSimhashIndex) GetNearDups(simhash *Simhash) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.evict(t.now())
+	return t.index.GetNearDups(simhash)
+}
+
+// Update replaces the fingerprint of a live object, which keeps its
+// insertion time, see SimhashIndex.Update
+func (t *TTLSimhashIndex) Update(objectID string, newSim *Simhash) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.evict(t.now())
+	return t.index.Update(objectID, newSim)
+}
+
+// GetNearDupsK is like GetNearDups with tolerance k, see
+// SimhashIndex.GetNearDupsK
+func (t *TTLSimhashIndex) GetNearDupsK(simhash *Simhash, k int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.evict(t.now())
+	return t.index.GetNearDupsK(simhash, k)
+}
+
+// Range evicts expired objects and calls fn for the remaining ones, see
+// SimhashIndex.Range
+func (t *TTLSimhashIndex) Range(fn func(objectID string, sim *Simhash) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.evict(t.now())
+	t.index.Range(fn)
+}
+
+func (t *TTLSimhashIndex) BucketSize() int {
+	return t.index.BucketSize()
+}
+
+// Sweep evicts the expired objects and returns how many were removed
+func (t *TTLSimhashIndex) Sweep() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.evict(t.now())
+}
+
+// Len returns the number of live objects
+func (t *TTLSimhashIndex) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.added)
+}
+
+func (t *TTLSimhashIndex) evict(now time.Time) int {
+	evicted := 0
+	for el := t.order.Front(); el != nil; el = t.order.Front() {
+		entry := el.Value.(ttlEntry)
+		if now.Sub(entry.added) <= t.ttl {
+			break
+		}
+		t.order.Remove(el)
+
+		if added, ok := t.added[entry.id]; !ok || !added.Equal(entry.added) {
+			continue
+		}
+		delete(t.added, entry.id)
+		// evictions are logged and counted like a DeleteByIDScan
+		t.index.mu.Lock()
+		t.index.logWAL(walDeleteByID, entry.id, nil, nil)
+		if t.index.removeObject(entry.id) {
+			t.index.deletes.Add(1)
+		}
+		t.index.mu.Unlock()
+		evicted++
+	}
+	return evicted
+}
+
+var _ Index = (*TTLSimhashIndex)(nil)
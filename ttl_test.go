@@ -0,0 +1,81 @@
+package simhash_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestTTLSimhashIndex(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	index := s.NewTTLSimhashIndex(s.NewSimhashIndex(nil), s.WithTTL(time.Hour), s.WithClock(clock))
+
+	old := s.NewSimhash("How are you? I Am fine. blar blar blar blar blar Thankg")
+	index.Add(s.Object{ObjectId: "old", S: old})
+
+	now = now.Add(40 * time.Minute)
+	fresh := s.NewSimhash("This is simhash test.")
+	index.Add(s.Object{ObjectId: "fresh", S: fresh})
+
+	t.Run("test live objects are found", func(t *testing.T) {
+		if dups := index.GetNearDups(old); len(dups) != 1 || dups[0] != "old" {
+			t.Errorf("Expected [old], got %v", dups)
+		}
+	})
+
+	t.Run("test expired objects are evicted", func(t *testing.T) {
+		now = now.Add(30 * time.Minute)
+		if dups := index.GetNearDups(old); len(dups) != 0 {
+			t.Errorf("Expected old to be expired, got %v", dups)
+		}
+		if dups := index.GetNearDups(fresh); len(dups) != 1 || dups[0] != "fresh" {
+			t.Errorf("Expected [fresh], got %v", dups)
+		}
+		if index.Len() != 1 {
+			t.Errorf("Expected 1 live object, got %d", index.Len())
+		}
+		if index.BucketSize() != 3 {
+			t.Errorf("Expected the expired buckets to be removed, got %d buckets", index.BucketSize())
+		}
+	})
+
+	t.Run("test re-adding refreshes", func(t *testing.T) {
+		index.Add(s.Object{ObjectId: "fresh", S: fresh})
+		now = now.Add(45 * time.Minute)
+		if n := index.Sweep(); n != 0 {
+			t.Errorf("Expected nothing to expire, got %d", n)
+		}
+		now = now.Add(30 * time.Minute)
+		if n := index.Sweep(); n != 1 {
+			t.Errorf("Expected fresh to expire, got %d", n)
+		}
+		if index.BucketSize() != 0 {
+			t.Errorf("Expected an empty index, got %d buckets", index.BucketSize())
+		}
+	})
+	t.Run("test evictions are logged", func(t *testing.T) {
+		var wal bytes.Buffer
+		inner := s.NewSimhashIndex(nil, s.SimhashIndexWithWAL(&wal))
+		logged := s.NewTTLSimhashIndex(inner, s.WithTTL(time.Hour), s.WithClock(clock))
+		logged.Add(s.Object{ObjectId: "old", S: old})
+		now = now.Add(2 * time.Hour)
+		if n := logged.Sweep(); n != 1 {
+			t.Fatalf("Expected old to expire, got %d", n)
+		}
+		if m := inner.Metrics(); m.Deletes != 1 || m.Objects != 0 {
+			t.Errorf("Expected 1 delete and no objects, got %+v", m)
+		}
+
+		replayed := s.NewSimhashIndex(nil)
+		if err := s.ReplayWAL(replayed, &wal); err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		if m := replayed.Metrics(); m.Objects != 0 {
+			t.Errorf("Expected the evicted object to stay gone after a replay, got %d objects", m.Objects)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package simhash
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Write-ahead log record operations
+const (
+	walAdd        byte = 'A'
+	walDelete     byte = 'D'
+	walDeleteByID byte = 'I'
+	// walAddTagged is an add followed by the object's tags, see appendTags
+	walAddTagged byte = 'T'
+)
+
+// SimhashIndexWithWAL makes the index append a record to w for every Add,
+// Delete, Update and DeleteByIDScan, before the change is applied. Together
+// with a snapshot from SaveCompact, ReplayWAL recovers the index. A record is
+// the operation, F, the varint length prefixed object id and the F/8 byte
+// fingerprint, which DeleteByIDScan records leave empty, followed by the
+// tags for adds of tagged objects. Write errors are logged and don't stop
+// the change.
+func SimhashIndexWithWAL(w io.Writer) IndexOptions {
+	return func(s *SimhashIndex) {
+		s.wal = w
+	}
+}
+
+// logWAL appends a record to the write-ahead log, if any, an add with tags
+// is logged as walAddTagged
+func (s *SimhashIndex) logWAL(op byte, objectID string, sim *Simhash, tags map[string]string) {
+	if s.wal == nil {
+		return
+	}
+	if op == walAdd && len(tags) > 0 {
+		op = walAddTagged
+	}
+	buf := appendObject(append(s.walBuf[:0], op), s.F, objectID, sim)
+	if op == walAddTagged {
+		buf = appendTags(buf, tags)
+	}
+	s.walBuf = buf
+	if _, err := s.wal.Write(buf); err != nil {
+		s.Log.Error("writing the write-ahead log failed", "op", string(op), "id", objectID, "err", err)
+	}
+}
+
+// ReplayWAL applies the records read from r to index, typically one loaded
+// from the snapshot the log was started after. Replaying is idempotent, so
+// records already reflected in the snapshot are harmless. The records are
+// not logged again to the index's own write-ahead log. It stops at the first
+// malformed record, a truncated last record, as left by a crash, is ignored.
+func ReplayWAL(index *SimhashIndex, r io.Reader) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+
+		objectID, sim, tags, err := readWALRecord(br, op)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			index.Log.Warn("ignoring a truncated write-ahead log record", "record", n)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		if sim != nil && sim.F != index.F {
+			return fmt.Errorf("record %d: %w: index has f %d, record %d", n, ErrDimensionMismatch, index.F, sim.F)
+		}
+
+		switch op {
+		case walAdd, walAddTagged:
+			index.add(Object{ObjectId: objectID, S: sim, Tags: tags})
+		case walDelete:
+			index.delete(Object{ObjectId: objectID, S: sim})
+		case walDeleteByID:
+			index.deleteByID(objectID)
+		}
+	}
+}
+
+// readWALRecord reads the rest of a record after its operation byte, any
+// end of input in the middle of it is reported as io.ErrUnexpectedEOF
+func readWALRecord(br *bufio.Reader, op byte) (string, *Simhash, map[string]string, error) {
+	if op != walAdd && op != walDelete && op != walDeleteByID && op != walAddTagged {
+		return "", nil, nil, fmt.Errorf("unknown operation %q", op)
+	}
+	id, sim, err := readObject(br, op != walDeleteByID)
+	if err != nil || op != walAddTagged {
+		return id, sim, nil, unexpectedEOF(err)
+	}
+	tags, err := readTags(br)
+	return id, sim, tags, unexpectedEOF(err)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package simhash_test
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"testing"
+
+	s "github.com/suryanshu-09/simhash"
+)
+
+func TestWAL(t *testing.T) {
+	sims := make([]*s.Simhash, 10)
+	for i := range sims {
+		sims[i] = s.NewSimhash("wal document " + strconv.Itoa(i) + " with its own words " + strconv.Itoa(i*7919))
+	}
+
+	var wal bytes.Buffer
+	index := s.NewSimhashIndex(nil, s.SimhashIndexWithWAL(&wal))
+	for i, sim := range sims[:6] {
+		index.Add(s.Object{ObjectId: strconv.Itoa(i), S: sim})
+	}
+	var snapshot bytes.Buffer
+	if err := index.SaveCompact(&snapshot); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	for i, sim := range sims[6:] {
+		index.Add(s.Object{ObjectId: strconv.Itoa(i + 6), S: sim})
+	}
+	index.Delete(s.Object{ObjectId: "0", S: sims[0]})
+	index.Update("1", sims[9])
+	index.DeleteByIDScan("2")
+	index.Add(s.Object{ObjectId: "3", S: sims[3]})
+
+	assertSame := func(t *testing.T, got *s.SimhashIndex) {
+		t.Helper()
+		if err := got.Validate(); err != nil {
+			t.Fatalf("Expected a valid index, got %v", err)
+		}
+		if got.Metrics().Objects != index.Metrics().Objects || got.BucketSize() != index.BucketSize() {
+			t.Errorf("Expected %d objects in %d buckets, got %d in %d", index.Metrics().Objects, index.BucketSize(), got.Metrics().Objects, got.BucketSize())
+		}
+		for _, sim := range sims {
+			expected, dups := index.GetNearDups(sim), got.GetNearDups(sim)
+			slices.Sort(expected)
+			slices.Sort(dups)
+			if !slices.Equal(dups, expected) {
+				t.Errorf("Expected %v, got %v", expected, dups)
+			}
+		}
+	}
+
+	t.Run("test snapshot plus log recovery", func(t *testing.T) {
+		recovered, err := s.LoadCompact(bytes.NewReader(snapshot.Bytes()))
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		if err := s.ReplayWAL(recovered, bytes.NewReader(wal.Bytes())); err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		assertSame(t, recovered)
+
+		// replaying again changes nothing
+		if err := s.ReplayWAL(recovered, bytes.NewReader(wal.Bytes())); err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		assertSame(t, recovered)
+	})
+
+	t.Run("test replay does not log again", func(t *testing.T) {
+		var second bytes.Buffer
+		recovered := s.NewSimhashIndex(nil, s.SimhashIndexWithWAL(&second))
+		if err := s.ReplayWAL(recovered, bytes.NewReader(wal.Bytes())); err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		assertSame(t, recovered)
+		if second.Len() != 0 {
+			t.Errorf("Expected no records written during replay, got %d bytes", second.Len())
+		}
+	})
+
+	t.Run("test truncated and corrupt logs", func(t *testing.T) {
+		truncated := wal.Bytes()[:wal.Len()-3]
+		if err := s.ReplayWAL(s.NewSimhashIndex(nil), bytes.NewReader(truncated)); err != nil {
+			t.Errorf("Expected a truncated last record to be ignored, got %v", err)
+		}
+		if err := s.ReplayWAL(s.NewSimhashIndex(nil), bytes.NewReader([]byte("Z"))); err == nil {
+			t.Error("Expected an error for an unknown operation")
+		}
+		if err := s.ReplayWAL(s.NewSimhashIndex(nil, s.SimhashIndexWithF(128)), bytes.NewReader(wal.Bytes())); err == nil {
+			t.Error("Expected an error replaying onto a different f")
+		}
+	})
+}